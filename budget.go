@@ -0,0 +1,143 @@
+package ezcache
+
+import (
+	"math/rand"
+	"runtime"
+	"sync/atomic"
+)
+
+// globalBudget enforces the capacity and maximum weight of a cache across
+// all of its shards, instead of splitting them into fixed per-shard shares.
+//
+// A slot is reserved before an entry is inserted, and released once it is
+// removed, so the number of entries never exceeds the capacity. If the budget
+// is exhausted, entries are evicted from shards sampled at random, locking
+// only one shard at a time.
+type globalBudget[K Key[K], V any] struct {
+	// Zero means no limit.
+	capacity  int64
+	maxWeight uint64
+
+	// Reserved entries and weight, and the number of entries that are
+	// actually stored. Accessed atomically.
+	entries int64
+	weight  uint64
+	stored  int64
+
+	// Logical clock that is advanced whenever an entry is used, to compare
+	// the victims of different shards. Accessed atomically.
+	tick uint64
+
+	shards []*shard[K, V]
+}
+
+// Number of shards whose victims are compared to find the one to evict.
+const budgetSampleSize = 4
+
+func newGlobalBudget[K Key[K], V any](capacity int, maxWeight uint64) *globalBudget[K, V] {
+	return &globalBudget[K, V]{
+		capacity:  int64(capacity),
+		maxWeight: maxWeight,
+	}
+}
+
+// tooHeavy returns true if an entry of the given weight can never fit.
+func (g *globalBudget[K, V]) tooHeavy(weight uint64) bool {
+	return g.maxWeight > 0 && weight > g.maxWeight
+}
+
+// reserve reserves room for a new entry of the given weight, evicting entries
+// until there is enough. It returns false if the entry is too heavy to ever
+// fit. The caller must not hold any shard lock.
+func (g *globalBudget[K, V]) reserve(weight uint64) bool {
+	if g.tooHeavy(weight) {
+		return false
+	}
+
+	for !g.tryReserve(weight) {
+		if !g.evict() {
+			// Everything is reserved by entries that are about to be
+			// inserted. Wait for them, so they can be evicted.
+			runtime.Gosched()
+		}
+	}
+
+	return true
+}
+
+func (g *globalBudget[K, V]) tryReserve(weight uint64) bool {
+	if atomic.AddInt64(&g.entries, 1) > g.capacity && g.capacity > 0 {
+		atomic.AddInt64(&g.entries, -1)
+		return false
+	}
+
+	if atomic.AddUint64(&g.weight, weight) > g.maxWeight && g.maxWeight > 0 {
+		atomic.AddUint64(&g.weight, -weight)
+		atomic.AddInt64(&g.entries, -1)
+		return false
+	}
+
+	return true
+}
+
+// grow adds weight to a slot that was reserved with zero weight, even if it
+// exceeds the maximum weight. It is used by writes that only know the weight
+// of an entry once they hold the shard lock, which must call enforce once
+// they released it. The number of entries can not be exceeded that way.
+func (g *globalBudget[K, V]) grow(weight uint64) {
+	atomic.AddUint64(&g.weight, weight)
+}
+
+// enforce evicts entries until the maximum weight is no longer exceeded, or
+// there is nothing left to evict. The caller must not hold any shard lock.
+func (g *globalBudget[K, V]) enforce() {
+	for g.maxWeight > 0 && atomic.LoadUint64(&g.weight) > g.maxWeight {
+		if !g.evict() {
+			return
+		}
+	}
+}
+
+// release gives back the room reserved for entries entries of the given
+// total weight.
+func (g *globalBudget[K, V]) release(entries int64, weight uint64) {
+	atomic.AddInt64(&g.entries, -entries)
+	atomic.AddUint64(&g.weight, -weight)
+}
+
+// evict evicts an entry. It samples the victims chosen by the eviction
+// policies of a few non-empty shards, starting at a random one, and evicts
+// the least recently used of them. It returns false if all shards are empty.
+func (g *globalBudget[K, V]) evict() bool {
+	var oldest *shard[K, V]
+	var oldestUsedAt uint64
+
+	start := rand.Intn(len(g.shards))
+	sampled := 0
+	for i := 0; i < len(g.shards) && sampled < budgetSampleSize; i++ {
+		s := g.shards[(start+i)%len(g.shards)]
+		usedAt, ok := s.victimUsedAt()
+		if !ok {
+			continue
+		}
+
+		sampled++
+		if oldest == nil || usedAt < oldestUsedAt {
+			oldest, oldestUsedAt = s, usedAt
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+
+	// The victim may have changed in the meantime. That is fine, as long as
+	// something is evicted.
+	return oldest.evictOne()
+}
+
+// use returns the current tick of the clock that orders uses of entries
+// across shards, and advances it.
+func (g *globalBudget[K, V]) use() uint64 {
+	return atomic.AddUint64(&g.tick, 1)
+}
@@ -1,18 +1,53 @@
 package ezcache
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var ErrNotFound = errors.New("not found")
 
+// ErrUnchanged can be returned by a ReloaderFn to signal that the value did
+// not change. The cache then keeps the current value, and only resets its
+// expiry.
+var ErrUnchanged = errors.New("unchanged")
+
 type CacheConfig[K Key[K], V any] struct {
 	capacity  int
 	numShards int
 	ttl       time.Duration
-	loader    LoaderFn[K, V]
+	loader    LoaderCtxFn[K, V]
+
+	bulkLoader BulkLoaderFn[K, V]
+
+	refreshAfter   time.Duration
+	onRefreshError func(key K, err error)
+	reloader       ReloaderFn[K, V]
+
+	expiry    Expiry[K, V]
+	accessTTL time.Duration
+
+	removalListener     RemovalListener[K, V]
+	listenerOutsideLock bool
+
+	policy PolicyFactory[K]
+
+	weigher   func(K, V) uint64
+	maxWeight uint64
+
+	globalCapacity bool
+
+	janitorInterval time.Duration
+
+	clock Clock
+
+	recordStats bool
+
+	instrumentation Instrumentation
 }
 
 func NewBuilder[K Key[K], V any]() *CacheConfig[K, V] {
@@ -23,6 +58,8 @@ func NewBuilder[K Key[K], V any]() *CacheConfig[K, V] {
 	}
 }
 
+// Capacity sets the maximum number of entries. Zero means that the cache is
+// unbounded, and entries are only removed when they expire.
 func (cb *CacheConfig[K, V]) Capacity(capacity int) *CacheConfig[K, V] {
 	cb.capacity = capacity
 	return cb
@@ -34,15 +71,175 @@ func (cb *CacheConfig[K, V]) NumShards(numShards int) *CacheConfig[K, V] {
 }
 
 func (cb *CacheConfig[K, V]) Loader(loader LoaderFn[K, V]) *CacheConfig[K, V] {
+	cb.loader = func(_ context.Context, key K) (V, error) {
+		return loader(key)
+	}
+	return cb
+}
+
+// LoaderCtx sets a loader that receives the context passed to GetCtx. It
+// replaces a loader set with Loader.
+func (cb *CacheConfig[K, V]) LoaderCtx(loader LoaderCtxFn[K, V]) *CacheConfig[K, V] {
 	cb.loader = loader
 	return cb
 }
 
+// BulkLoader sets a loader that is used by GetAll to load all missing keys
+// with a single call. If no other loader is set, Get uses it as well.
+func (cb *CacheConfig[K, V]) BulkLoader(loader BulkLoaderFn[K, V]) *CacheConfig[K, V] {
+	cb.bulkLoader = loader
+	return cb
+}
+
+// TTL sets the time after which entries expire once they are written. Zero
+// means that entries never expire; in that case no expiry bookkeeping is
+// done at all.
 func (cb *CacheConfig[K, V]) TTL(ttl time.Duration) *CacheConfig[K, V] {
 	cb.ttl = ttl
 	return cb
 }
 
+// RefreshAfter enables refresh-ahead: reading an entry that was written more
+// than refreshAfter ago returns its current value immediately, and reloads it
+// in the background. Only one refresh per key runs at a time. To have an
+// effect, refreshAfter must be shorter than the TTL, and a loader must be set.
+func (cb *CacheConfig[K, V]) RefreshAfter(refreshAfter time.Duration) *CacheConfig[K, V] {
+	cb.refreshAfter = refreshAfter
+	return cb
+}
+
+// Reloader sets the func used to refresh entries that are already cached,
+// both by refresh-ahead and by Refresh. Unlike the loader, it receives the
+// current value, and can return ErrUnchanged to keep it. Keys that are not
+// cached are still loaded with the loader.
+func (cb *CacheConfig[K, V]) Reloader(reloader ReloaderFn[K, V]) *CacheConfig[K, V] {
+	cb.reloader = reloader
+	return cb
+}
+
+// OnRefreshError sets a func that is called if a background refresh fails.
+// The entry keeps its current value in that case.
+func (cb *CacheConfig[K, V]) OnRefreshError(onRefreshError func(key K, err error)) *CacheConfig[K, V] {
+	cb.onRefreshError = onRefreshError
+	return cb
+}
+
+// Expiry sets a policy that computes the expiry of each entry individually.
+// It replaces the TTL.
+func (cb *CacheConfig[K, V]) Expiry(expiry Expiry[K, V]) *CacheConfig[K, V] {
+	cb.expiry = expiry
+	return cb
+}
+
+// ExpireAfterAccess lets entries expire once they were not read or written
+// for accessTTL. It can be combined with TTL or Expiry, in which case an
+// entry expires at whichever deadline comes first.
+func (cb *CacheConfig[K, V]) ExpireAfterAccess(accessTTL time.Duration) *CacheConfig[K, V] {
+	cb.accessTTL = accessTTL
+	return cb
+}
+
+// RemovalListener sets a listener that is notified about every entry that is
+// removed from the cache, or whose value is replaced. It is called while the
+// shard of the entry is locked, so it sees removals in the order they happen,
+// but must not access the cache, and should be fast.
+func (cb *CacheConfig[K, V]) RemovalListener(listener RemovalListener[K, V]) *CacheConfig[K, V] {
+	cb.removalListener = listener
+	cb.listenerOutsideLock = false
+	return cb
+}
+
+// RemovalListenerOutsideLock is like RemovalListener, but the listener is
+// called after the shard lock was released, by the goroutine that caused the
+// removal. A slow listener therefore does not block other callers, and it may
+// access the cache. Notifications from different goroutines are not ordered.
+func (cb *CacheConfig[K, V]) RemovalListenerOutsideLock(listener RemovalListener[K, V]) *CacheConfig[K, V] {
+	cb.removalListener = listener
+	cb.listenerOutsideLock = true
+	return cb
+}
+
+// TinyLFU makes the cache use the W-TinyLFU policy instead of LRU to decide
+// which entries to evict. New entries are only admitted to the bulk of the
+// cache if they are estimated to be used more often than the entries they
+// replace, which protects frequently used entries from being flushed by
+// scans over keys that are used once.
+func (cb *CacheConfig[K, V]) TinyLFU() *CacheConfig[K, V] {
+	return cb.EvictionPolicy(NewTinyLFUPolicy[K])
+}
+
+// EvictionPolicy sets the policy that decides which entries to evict once
+// the cache is full. Each shard gets its own instance, created with the
+// capacity of the shard. Defaults to NewLRUPolicy.
+func (cb *CacheConfig[K, V]) EvictionPolicy(policy PolicyFactory[K]) *CacheConfig[K, V] {
+	cb.policy = policy
+	return cb
+}
+
+// Weigher sets a func that computes the weight of an entry, e.g. the size of
+// its value in bytes. It is called whenever an entry is written. Without a
+// weigher, every entry weighs 1.
+func (cb *CacheConfig[K, V]) Weigher(weigher func(K, V) uint64) *CacheConfig[K, V] {
+	cb.weigher = weigher
+	return cb
+}
+
+// MaxWeight bounds the total weight of the entries in the cache. Each shard
+// gets an equal share of it, and evicts entries until a new one fits. Entries
+// heavier than the share of a shard are not cached at all. Capacity still
+// bounds the number of entries, and is what eviction policies are sized by;
+// set it to zero to bound the cache by weight only. Zero means no limit.
+func (cb *CacheConfig[K, V]) MaxWeight(maxWeight uint64) *CacheConfig[K, V] {
+	cb.maxWeight = maxWeight
+	return cb
+}
+
+// GlobalCapacity enforces Capacity and MaxWeight across all shards, instead
+// of splitting them evenly between the shards. A shard can then use the room
+// that other shards do not need, which helps if keys are not evenly
+// distributed. If the cache is full, entries are evicted from randomly
+// sampled shards, using the victims chosen by their eviction policies. The
+// cache never holds more than Capacity entries, at the cost of atomic
+// operations on shared counters for each write. Compute and Merge only learn
+// the weight of an entry once they computed it, so they may exceed MaxWeight
+// until they return.
+func (cb *CacheConfig[K, V]) GlobalCapacity() *CacheConfig[K, V] {
+	cb.globalCapacity = true
+	return cb
+}
+
+// Janitor starts a goroutine that removes expired entries from all shards
+// every interval. Without it, expired entries are only removed in small
+// batches while a shard is accessed, so they can stay in memory for a long
+// time on shards that are rarely used. The goroutine is stopped by Close.
+func (cb *CacheConfig[K, V]) Janitor(interval time.Duration) *CacheConfig[K, V] {
+	cb.janitorInterval = interval
+	return cb
+}
+
+// Clock sets the clock that is used to expire and refresh entries. Defaults
+// to the system clock. CoarseClock is cheaper, at the cost of precision; in
+// tests, a fake clock from package clocktest makes expiry and refreshes
+// deterministic.
+func (cb *CacheConfig[K, V]) Clock(clock Clock) *CacheConfig[K, V] {
+	cb.clock = clock
+	return cb
+}
+
+// RecordStats makes the cache record statistics, which are returned by
+// Stats. Recording them costs a few atomic increments per operation.
+func (cb *CacheConfig[K, V]) RecordStats() *CacheConfig[K, V] {
+	cb.recordStats = true
+	return cb
+}
+
+// Instrumentation sets an Instrumentation that is notified of lookups with
+// GetCtx and of loads, e.g. to trace them.
+func (cb *CacheConfig[K, V]) Instrumentation(instrumentation Instrumentation) *CacheConfig[K, V] {
+	cb.instrumentation = instrumentation
+	return cb
+}
+
 func (cb *CacheConfig[K, V]) Build() *Cache[K, V] {
 	return New(cb)
 }
@@ -53,28 +250,195 @@ type HashCoder interface {
 
 func New[K Key[K], V any](cfg *CacheConfig[K, V]) *Cache[K, V] {
 	cache := Cache[K, V]{
-		loaderFn:  cfg.loader,
-		numShards: uint64(cfg.numShards),
-		capacity:  cfg.capacity,
+		loaderFn:     cfg.loader,
+		bulkLoaderFn: cfg.bulkLoader,
+		numShards:    uint64(cfg.numShards),
+		capacity:     cfg.capacity,
+	}
+
+	if cache.loaderFn == nil && cache.bulkLoaderFn != nil {
+		cache.loaderFn = singleKeyLoader(cache.bulkLoaderFn)
+	}
+
+	var global *globalBudget[K, V]
+	if cfg.globalCapacity && (cfg.capacity > 0 || cfg.maxWeight > 0) {
+		global = newGlobalBudget[K, V](cfg.capacity, cfg.maxWeight)
 	}
 
 	cache.shards = make([]*shard[K, V], 0, cache.numShards)
 	for i := 0; i < int(cache.numShards); i++ {
-		newShard := newShard[K, V]((cache.capacity/int(cache.numShards))+1, cfg.ttl)
+		shardCapacity := 0
+		if cache.capacity > 0 {
+			shardCapacity = (cache.capacity / int(cache.numShards)) + 1
+		}
+
+		localCapacity := shardCapacity
+		if global != nil {
+			// The shard is only bounded by the global budget. Its share
+			// of the capacity is only used to size the eviction policy.
+			localCapacity = 0
+		}
+
+		newShard := newShard[K, V](localCapacity, cfg.ttl)
+		newShard.refreshAfter = cfg.refreshAfter
+		newShard.onRefreshError = cfg.onRefreshError
+		newShard.reloaderFn = cfg.reloader
+		newShard.expiry = cfg.expiry
+		newShard.accessTTL = cfg.accessTTL
+		newShard.removalListener = cfg.removalListener
+		newShard.listenerOutsideLock = cfg.listenerOutsideLock
+		newShard.weigher = cfg.weigher
+		if cfg.clock != nil {
+			newShard.clock = cfg.clock
+		}
+		if cfg.recordStats {
+			newShard.stats = &statsCounter{}
+		}
+		newShard.index = i
+		newShard.instrumentation = cfg.instrumentation
+		if global != nil {
+			newShard.global = global
+		} else if cfg.maxWeight > 0 {
+			// Round up, so the shards together can hold at least maxWeight.
+			newShard.maxWeight = (cfg.maxWeight + cache.numShards - 1) / cache.numShards
+		}
+		// Unbounded shards need no eviction policy.
+		if localCapacity > 0 || newShard.global != nil || newShard.maxWeight > 0 {
+			newPolicy := cfg.policy
+			if newPolicy == nil {
+				newPolicy = NewLRUPolicy[K]
+			}
+			newShard.newPolicy = func() EvictionPolicy[K] { return newPolicy(shardCapacity) }
+			newShard.policy = newShard.newPolicy()
+		}
 		cache.shards = append(cache.shards, newShard)
 	}
 
+	if global != nil {
+		global.shards = cache.shards
+	}
+
+	if clock, ok := cfg.clock.(AdvancingClock); ok {
+		cache.stopClock = clock.OnAdvance(cache.onAdvance)
+	}
+
+	if cfg.janitorInterval > 0 {
+		cache.stopJanitor = make(chan struct{})
+		cache.janitorDone = make(chan struct{})
+		go cache.runJanitor(cfg.janitorInterval)
+	}
+
 	return &cache
 }
 
 type LoaderFn[K Key[K], V any] func(key K) (value V, err error)
 
+// LoaderCtxFn is a loader that is aware of the context of the caller. The
+// context carries the values of the caller that triggered the load, and is
+// cancelled once all callers waiting for the load have given up. Its deadline
+// is the latest deadline of these callers, if all of them have one.
+type LoaderCtxFn[K Key[K], V any] func(ctx context.Context, key K) (value V, err error)
+
+// BulkLoaderFn loads the values of several keys at once. Keys that are
+// missing from the returned map are considered not found.
+type BulkLoaderFn[K Key[K], V any] func(ctx context.Context, keys []K) (values *HashMap[K, V], err error)
+
+// singleKeyLoader adapts a bulk loader to load single keys.
+func singleKeyLoader[K Key[K], V any](bulkLoaderFn BulkLoaderFn[K, V]) LoaderCtxFn[K, V] {
+	return func(ctx context.Context, key K) (V, error) {
+		values, err := bulkLoaderFn(ctx, []K{key})
+		if err != nil {
+			return *new(V), err
+		}
+
+		value, found := values.Get(key)
+		if !found {
+			return *new(V), ErrNotFound
+		}
+
+		return value, nil
+	}
+}
+
+// ReloaderFn reloads the value of a key that is already cached. old is the
+// current value. If the value did not change, it may return ErrUnchanged.
+type ReloaderFn[K Key[K], V any] func(ctx context.Context, key K, old V) (value V, err error)
+
 type Cache[K Key[K], V any] struct {
-	loaderFn  LoaderFn[K, V]
-	numShards uint64
-	capacity  int
+	loaderFn     LoaderCtxFn[K, V]
+	bulkLoaderFn BulkLoaderFn[K, V]
+	numShards    uint64
+	capacity     int
 
 	shards []*shard[K, V]
+
+	// Closed by Close to stop the janitor, which closes janitorDone once it
+	// returned. Nil if there is no janitor.
+	stopJanitor chan struct{}
+	janitorDone chan struct{}
+	closeOnce   sync.Once
+
+	// Unsubscribes from the clock, if it is an AdvancingClock.
+	stopClock func()
+}
+
+// runJanitor removes expired entries from all shards every interval, until
+// Close is called.
+func (c *Cache[K, V]) runJanitor(interval time.Duration) {
+	defer close(c.janitorDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.cleanAll()
+		case <-c.stopJanitor:
+			return
+		}
+	}
+}
+
+// cleanAll removes all expired entries.
+func (c *Cache[K, V]) cleanAll() {
+	for _, shard := range c.shards {
+		shard.cleanAll()
+	}
+}
+
+// onAdvance is called whenever an AdvancingClock advanced. It removes the
+// entries that expired, and refreshes the entries that became due for a
+// refresh, waiting until the refreshes completed.
+func (c *Cache[K, V]) onAdvance() {
+	c.cleanAll()
+
+	var calls []*call[V]
+	for _, shard := range c.shards {
+		calls = append(calls, shard.refreshDue(c.loaderFn)...)
+	}
+	for _, call := range calls {
+		<-call.done
+	}
+}
+
+// Close stops the janitor, and waits until it returned. It also unsubscribes
+// from an AdvancingClock. The cache can still be used afterwards, but expired
+// entries are only removed while shards are accessed. Close can be called
+// more than once.
+func (c *Cache[K, V]) Close() {
+	c.closeOnce.Do(func() {
+		if c.stopClock != nil {
+			c.stopClock()
+		}
+		if c.stopJanitor != nil {
+			close(c.stopJanitor)
+		}
+	})
+
+	if c.janitorDone != nil {
+		<-c.janitorDone
+	}
 }
 
 func (c *Cache[K, V]) getShard(hash uint64) *shard[K, V] {
@@ -88,32 +452,555 @@ func (c *Cache[K, V]) Set(key K, value V) {
 	shard.set(key, keyHash, value)
 }
 
+// GetOrSet returns the value of key if it is cached. Otherwise, it sets it to
+// value and returns that. loaded is true if the value was cached.
+func (c *Cache[K, V]) GetOrSet(key K, value V) (actual V, loaded bool) {
+	keyHash := key.HashCode()
+	actual, _ = c.getShard(keyHash).computeValue(key, keyHash, value, func(old V, ok bool) Op {
+		loaded = ok
+		if ok {
+			return OpKeep
+		}
+		return OpSet
+	})
+
+	return actual, loaded
+}
+
+// SetIfAbsent sets the value of key, unless it is cached. It returns true if
+// the value was set.
+func (c *Cache[K, V]) SetIfAbsent(key K, value V) bool {
+	_, loaded := c.GetOrSet(key, value)
+	return !loaded
+}
+
+// Replace sets the value of key, but only if it is cached. It returns the
+// previous value, and true if it was replaced.
+func (c *Cache[K, V]) Replace(key K, value V) (previous V, replaced bool) {
+	keyHash := key.HashCode()
+	c.getShard(keyHash).computeValue(key, keyHash, value, func(old V, ok bool) Op {
+		previous, replaced = old, ok
+		if ok {
+			return OpSet
+		}
+		return OpKeep
+	})
+
+	return previous, replaced
+}
+
+// Compute atomically updates the entry of key: fn is passed its current
+// value, and ok is true if it is cached. The Op returned by fn decides whether
+// the entry is kept as it is, set to the value returned by fn, or deleted.
+// Compute returns the value of key afterwards, and whether it is cached.
+//
+// fn is called while the shard of key is locked, so it must not use the
+// cache, and should be fast. Like Set, setting a value removes the tags of
+// the entry, and a load of key that is in flight is not written.
+func (c *Cache[K, V]) Compute(key K, fn func(old V, ok bool) (V, Op)) (V, bool) {
+	keyHash := key.HashCode()
+	return c.getShard(keyHash).compute(key, keyHash, fn)
+}
+
+// ComputeIfPresent is like Compute, but only calls fn if key is cached.
+func (c *Cache[K, V]) ComputeIfPresent(key K, fn func(old V) (V, Op)) (V, bool) {
+	return c.Compute(key, func(old V, ok bool) (V, Op) {
+		if !ok {
+			return old, OpKeep
+		}
+		return fn(old)
+	})
+}
+
+// Merge sets the value of key to value if it is not cached, and to the
+// result of fn otherwise, which is passed the cached value and value. It
+// returns the value of key afterwards. Like with Compute, fn must not use the
+// cache.
+func (c *Cache[K, V]) Merge(key K, value V, fn func(old, value V) V) V {
+	merged, _ := c.Compute(key, func(old V, ok bool) (V, Op) {
+		if !ok {
+			return value, OpSet
+		}
+		return fn(old, value), OpSet
+	})
+
+	return merged
+}
+
+// GetVersioned is like Get, but also returns the version of the entry. Every
+// write to an entry gives it a new, higher version, so the version can be
+// passed to CompareAndSet to only update the entry if nobody else wrote it in
+// the meantime. If the value had to be loaded, the version of the loaded
+// entry is returned, or 0 if it was not written to the cache.
+func (c *Cache[K, V]) GetVersioned(key K) (value V, version uint64, err error) {
+	keyHash := key.HashCode()
+	shard := c.getShard(keyHash)
+
+	value, version, found := shard.getVersioned(key, keyHash)
+	if found {
+		shard.stats.recordHit()
+		return value, version, nil
+	}
+	if c.loaderFn == nil {
+		shard.stats.recordMiss()
+		return *new(V), 0, ErrNotFound
+	}
+
+	// Records the miss, or a hit if another write happened meanwhile.
+	value, err = c.Get(key)
+	if err != nil {
+		return *new(V), 0, err
+	}
+
+	// Another write may have happened after the load. Return it, so its
+	// version matches the value.
+	if current, version, found := shard.getVersioned(key, keyHash); found {
+		return current, version, nil
+	}
+
+	return value, 0, nil
+}
+
+// CompareAndSet sets the value of key, but only if the version of its entry
+// is expected, as returned by GetVersioned. An expected version of 0 only
+// sets the value if key is absent. It returns true if the value was set.
+// Like Set, it removes the tags of the entry.
+func (c *Cache[K, V]) CompareAndSet(key K, expected uint64, value V) bool {
+	keyHash := key.HashCode()
+	return c.getShard(keyHash).compareAndSet(key, keyHash, expected, value)
+}
+
+// Peek returns the value of key if it is cached, like Get. Unlike Get, it
+// never loads the value, and does not count as an access: it affects neither
+// the eviction order, the expiry or the hit count of the entry, nor the
+// statistics.
+func (c *Cache[K, V]) Peek(key K) (V, bool) {
+	keyHash := key.HashCode()
+	shard := c.getShard(keyHash)
+
+	shard.m.RLock()
+	defer shard.m.RUnlock()
+
+	entry, ok := shard.peek(key, keyHash)
+	if !ok {
+		return *new(V), false
+	}
+
+	return entry.value, true
+}
+
+// GetEntry is like Peek, but returns the value of key together with the
+// metadata of its entry.
+func (c *Cache[K, V]) GetEntry(key K) (EntryInfo[V], bool) {
+	keyHash := key.HashCode()
+	shard := c.getShard(keyHash)
+
+	shard.m.RLock()
+	defer shard.m.RUnlock()
+
+	entry, ok := shard.peek(key, keyHash)
+	if !ok {
+		return EntryInfo[V]{}, false
+	}
+
+	return shard.entryInfo(entry), true
+}
+
+// SetWithTags is like Set, but attaches tags to the entry, so it can be
+// removed with InvalidateTag. Like every write, it replaces the tags the
+// entry had before; Set removes them. Loaders attach tags with AddTags.
+func (c *Cache[K, V]) SetWithTags(key K, value V, tags ...string) {
+	keyHash := key.HashCode()
+	shard := c.getShard(keyHash)
+
+	shard.setWithTTL(key, keyHash, value, useDefaultTTL, tags...)
+}
+
+// InvalidateTag removes all entries carrying tag, and returns the number of
+// them that did not expire. The removal listener is notified of each with
+// RemovalExplicit. Loads that are in flight for them complete, but their
+// results are not written to the cache.
+func (c *Cache[K, V]) InvalidateTag(tag string) int {
+	removed := 0
+	for _, shard := range c.shards {
+		removed += shard.invalidateTag(tag)
+	}
+
+	return removed
+}
+
+// SetWithTTL is like Set, but lets the entry expire after ttl, regardless of
+// the cache's TTL or Expiry. A non-positive ttl means that the entry never
+// expires.
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = 0
+	}
+
+	keyHash := key.HashCode()
+	shard := c.getShard(keyHash)
+
+	shard.setWithTTL(key, keyHash, value, ttl)
+}
+
 func (c *Cache[K, V]) Get(key K) (V, error) {
+	return c.GetCtx(context.Background(), key)
+}
+
+// GetCtx is like Get, but passes ctx to the loader. If ctx is done before the
+// value is loaded, GetCtx returns ctx.Err(). The load itself keeps running as
+// long as other callers are waiting for the same key.
+func (c *Cache[K, V]) GetCtx(ctx context.Context, key K) (V, error) {
 	keyHash := key.HashCode()
 	shard := c.getShard(keyHash)
-	result, found := shard.get(key, keyHash)
 
-	if !found {
-		if c.loaderFn == nil {
-			return *new(V), ErrNotFound
+	instrumentation := shard.instrumentation
+	if instrumentation == nil {
+		value, result := c.get(ctx, shard, key, keyHash)
+		return value, result.Err
+	}
+
+	ctx, end := instrumentation.StartGet(ctx, GetInfo{KeyHash: keyHash, Shard: shard.index})
+	value, result := c.get(ctx, shard, key, keyHash)
+	end(result)
+
+	return value, result.Err
+}
+
+func (c *Cache[K, V]) get(ctx context.Context, shard *shard[K, V], key K, keyHash uint64) (V, GetResult) {
+	if c.loaderFn == nil {
+		value, found := shard.get(key, keyHash)
+		if !found {
+			return *new(V), GetResult{Err: ErrNotFound}
 		}
-		value, err := c.loaderFn(key)
-		if err != nil {
-			return *new(V), fmt.Errorf("failed to run loader: %w", err)
+		return value, GetResult{Hit: true}
+	}
+
+	// Concurrent misses on the same key share a single call to the loader.
+	return shard.load(ctx, key, keyHash, c.loaderFn)
+}
+
+// GetAll returns the values of all given keys. Keys that are not cached are
+// loaded: with a single call to the bulk loader if there is one, otherwise
+// with the loader, one key at a time. Keys that could not be found are absent
+// from the result, and do not fail the call.
+func (c *Cache[K, V]) GetAll(keys []K) (*HashMap[K, V], error) {
+	return c.GetAllCtx(context.Background(), keys)
+}
+
+// GetAllCtx is like GetAll, but passes ctx to the loaders. If ctx is done
+// before all values are loaded, GetAllCtx returns ctx.Err().
+func (c *Cache[K, V]) GetAllCtx(ctx context.Context, keys []K) (*HashMap[K, V], error) {
+	result := NewHashMap[K, V](len(keys) + 1)
+
+	// Group the keys by shard, so every shard is only locked once.
+	hashes := make([]uint64, len(keys))
+	byShard := make([][]int, c.numShards)
+	for i, key := range keys {
+		hashes[i] = key.HashCode()
+		shardIdx := hashes[i] % c.numShards
+		byShard[shardIdx] = append(byShard[shardIdx], i)
+	}
+
+	type pendingLoad struct {
+		idx  int
+		call *call[V]
+	}
+
+	var pending, started []pendingLoad
+
+	newCallFn := func() *call[V] { return newCall[V](ctx) }
+
+	// All keys loaded by the bulk loader share its context.
+	var group *callGroup
+	if c.bulkLoaderFn != nil {
+		group = newCallGroup(ctx)
+		newCallFn = func() *call[V] { return newGroupCall[V](group) }
+	}
+
+	for shardIdx, indices := range byShard {
+		if len(indices) == 0 {
+			continue
 		}
 
-		// Since we don't hold the lock between get and set, it might be that we shadow other concurrent loads&writes.
-		// It might be helpful to allow only one cache load per key concurrently, to avoid thundering herd etc.
-		shard.set(key, keyHash, value)
-		return value, nil
+		shard := c.shards[shardIdx]
+		shard.lock()
+		shard.clean()
+		for _, i := range indices {
+			if c.loaderFn == nil {
+				if value, found := shard.getLocked(keys[i], hashes[i]); found {
+					result.SetH(keys[i], value, hashes[i])
+				}
+				continue
+			}
+
+			value, found, call, isNew := shard.getOrReserve(ctx, keys[i], hashes[i], newCallFn)
+			if found {
+				if isNew {
+					go shard.backgroundRefresh(call, keys[i], hashes[i], value, c.loaderFn)
+				}
+				result.SetH(keys[i], value, hashes[i])
+				continue
+			}
+
+			pending = append(pending, pendingLoad{i, call})
+			if isNew {
+				started = append(started, pendingLoad{i, call})
+			}
+		}
+		shard.unlock()
+	}
+
+	switch {
+	case c.bulkLoaderFn != nil && len(started) > 0:
+		toLoad := make([]K, 0, len(started))
+		for _, p := range started {
+			toLoad = append(toLoad, keys[p.idx])
+		}
+
+		go func() {
+			defer group.cancel()
+
+			// A bulk load counts as a single load, which is recorded by the
+			// shard of the first key.
+			first := c.getShard(hashes[started[0].idx])
+			ctx, end := first.startLoad(group.ctx, LoadInfo{
+				KeyHash: hashes[started[0].idx],
+				Shard:   first.index,
+				Keys:    len(toLoad),
+			})
+			values, err := callBulkLoader(ctx, toLoad, c.bulkLoaderFn)
+			end(err)
+			if err != nil {
+				err = fmt.Errorf("failed to run bulk loader: %w", err)
+			}
+
+			for _, p := range started {
+				key, keyHash := keys[p.idx], hashes[p.idx]
+				shard := c.getShard(keyHash)
+
+				if err != nil {
+					shard.finishLoad(p.call, key, keyHash, *new(V), err)
+					continue
+				}
+
+				value, found := values.GetH(key, keyHash)
+				if !found {
+					shard.finishLoad(p.call, key, keyHash, *new(V), ErrNotFound)
+					continue
+				}
+				shard.finishLoad(p.call, key, keyHash, value, nil)
+			}
+		}()
+	case c.bulkLoaderFn != nil:
+		group.cancel()
+	default:
+		for _, p := range started {
+			go c.getShard(hashes[p.idx]).runLoad(p.call, keys[p.idx], hashes[p.idx], c.loaderFn)
+		}
+	}
+
+	for i, p := range pending {
+		key, keyHash := keys[p.idx], hashes[p.idx]
+		value, err := c.getShard(keyHash).wait(ctx, key, keyHash, p.call)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			// Stop waiting for the remaining loads.
+			for _, rest := range pending[i+1:] {
+				c.getShard(hashes[rest.idx]).abandon(keys[rest.idx], hashes[rest.idx], rest.call)
+			}
+			return nil, err
+		}
+		result.SetH(key, value, keyHash)
 	}
 
 	return result, nil
 }
 
+// Refresh reloads the value of key, and waits until that is done. A cached
+// key is reloaded with the reloader if there is one, or otherwise with the
+// loader; a key that is not cached is loaded with the loader. If the reload
+// fails, the current value is kept and the error is returned.
+func (c *Cache[K, V]) Refresh(key K) error {
+	return c.RefreshCtx(context.Background(), key)
+}
+
+// RefreshCtx is like Refresh, but passes ctx to the loaders.
+func (c *Cache[K, V]) RefreshCtx(ctx context.Context, key K) error {
+	keyHash := key.HashCode()
+	shard := c.getShard(keyHash)
+
+	return shard.refresh(ctx, key, keyHash, c.loaderFn)
+}
+
+// InvalidateAll removes all entries from the cache. Each shard is reset at
+// once, without visiting its entries, unless there is a removal listener:
+// it is notified of every entry with RemovalExplicit. Loads that are in
+// flight complete, but their results are not written to the cache.
+func (c *Cache[K, V]) InvalidateAll() {
+	for _, shard := range c.shards {
+		shard.clear(true)
+	}
+}
+
+// Clear is like InvalidateAll, but never notifies the removal listener, so
+// it always takes constant time per shard.
+func (c *Cache[K, V]) Clear() {
+	for _, shard := range c.shards {
+		shard.clear(false)
+	}
+}
+
+// InvalidateIf removes all entries that did not expire and for which fn
+// returns true, and returns their number. The removal listener is notified
+// of each with RemovalExplicit. fn is called while the shard of the entry is
+// locked, so it must not use the cache. Shards are visited one at a time, so
+// entries written to a shard after it was visited are not removed.
+func (c *Cache[K, V]) InvalidateIf(fn func(key K, value V) bool) int {
+	removed := 0
+	for _, shard := range c.shards {
+		removed += shard.invalidateIf(fn)
+	}
+
+	return removed
+}
+
+// Len returns the number of entries in the cache. Entries that expired, but
+// were not removed yet, are included.
+func (c *Cache[K, V]) Len() int {
+	if global := c.shards[0].global; global != nil {
+		// Summing up the shards could count an entry that moved between
+		// them twice.
+		return int(atomic.LoadInt64(&global.stored))
+	}
+
+	length := 0
+	for _, shard := range c.shards {
+		length += shard.Len()
+	}
+
+	return length
+}
+
+// Range calls fn for each entry in the cache that did not expire, in no
+// particular order, until fn returns false. Reading entries with Range does
+// not count as an access: it affects neither their eviction or expiry, nor
+// the statistics.
+//
+// Range visits the cache shard by shard. The entries of a shard are copied
+// while holding its read lock, and fn is called after releasing it, so fn
+// may use the cache. Range is not a snapshot: concurrent writes to a shard
+// are only seen if they happen before the shard is visited, and entries that
+// are removed after their shard was visited are still passed to fn. Each key
+// is visited at most once. Use Snapshot for a consistent copy.
+func (c *Cache[K, V]) Range(fn func(key K, value V) bool) {
+	var entries []entry[K, V]
+	for _, shard := range c.shards {
+		shard.m.RLock()
+		entries = shard.appendEntries(entries[:0], shard.clock.Now().UnixMilli())
+		shard.m.RUnlock()
+
+		for _, e := range entries {
+			if !fn(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// Keys returns the keys of all entries that did not expire, with the same
+// semantics as Range.
+func (c *Cache[K, V]) Keys() []K {
+	keys := make([]K, 0, c.Len())
+	c.Range(func(key K, _ V) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	return keys
+}
+
+// Values returns the values of all entries that did not expire, with the
+// same semantics as Range.
+func (c *Cache[K, V]) Values() []V {
+	values := make([]V, 0, c.Len())
+	c.Range(func(_ K, value V) bool {
+		values = append(values, value)
+		return true
+	})
+
+	return values
+}
+
+// Snapshot returns a copy of all entries that did not expire. Unlike Range,
+// it is consistent: the read locks of all shards are held while copying, so
+// the copy reflects the cache at a single point in time. Writes to the cache
+// are blocked in the meantime.
+func (c *Cache[K, V]) Snapshot() *HashMap[K, V] {
+	for _, shard := range c.shards {
+		shard.m.RLock()
+	}
+
+	size := 0
+	for _, shard := range c.shards {
+		size += shard.dataMap.Len()
+	}
+
+	now := c.shards[0].clock.Now().UnixMilli()
+	entries := make([]entry[K, V], 0, size)
+	for _, shard := range c.shards {
+		entries = shard.appendEntries(entries, now)
+	}
+
+	for _, shard := range c.shards {
+		shard.m.RUnlock()
+	}
+
+	snapshot := NewHashMap[K, V](len(entries) + 1)
+	for _, e := range entries {
+		snapshot.SetH(e.key, e.value, e.hash)
+	}
+
+	return snapshot
+}
+
+// ShardLens returns the number of entries in each shard.
+func (c *Cache[K, V]) ShardLens() []int {
+	lens := make([]int, len(c.shards))
+	for i, shard := range c.shards {
+		lens[i] = shard.Len()
+	}
+
+	return lens
+}
+
+// Stats returns a snapshot of the statistics of the cache. All counters are
+// zero unless the cache was built with RecordStats.
+func (c *Cache[K, V]) Stats() Stats {
+	var stats Stats
+	for _, shard := range c.shards {
+		shard.stats.addTo(&stats)
+	}
+
+	return stats
+}
+
+// Weight returns the total weight of all entries in the cache, as computed by
+// the weigher. Without a weigher, it is the number of entries.
+func (c *Cache[K, V]) Weight() uint64 {
+	var weight uint64
+	for _, shard := range c.shards {
+		weight += shard.Weight()
+	}
+
+	return weight
+}
+
 func (c *Cache[K, V]) Delete(key K) {
 	keyHash := key.HashCode()
 	shard := c.getShard(keyHash)
 
-	shard.delete(key)
+	shard.Delete(key)
 }
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func BenchmarkSetString(b *testing.B) {
@@ -188,3 +189,60 @@ func BenchmarkParallelSet(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkExpiryModes(b *testing.B) {
+	modes := []struct {
+		name     string
+		capacity int
+		ttl      time.Duration
+	}{
+		{name: "LRU+TTL", capacity: 1024, ttl: time.Hour},
+		{name: "LRU-NoTTL", capacity: 1024, ttl: 0},
+		{name: "Unbounded+TTL", capacity: 0, ttl: time.Hour},
+		{name: "Unbounded-NoTTL", capacity: 0, ttl: 0},
+	}
+
+	for _, mode := range modes {
+		cfg := NewBuilder[IntKey, int]().Capacity(mode.capacity).TTL(mode.ttl).NumShards(1)
+
+		b.Run(mode.name+"/Set", func(b *testing.B) {
+			cache := cfg.Build()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				cache.Set(IntKey(i%1024), i)
+			}
+		})
+		b.Run(mode.name+"/Get", func(b *testing.B) {
+			cache := cfg.Build()
+			for i := 0; i < 1024; i++ {
+				cache.Set(IntKey(i), i)
+			}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, _ = cache.Get(IntKey(i % 1024))
+			}
+		})
+	}
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	for _, buckets := range []int{1, 16} {
+		b.Run(fmt.Sprintf("Buckets-%v", buckets), func(b *testing.B) {
+			cache := NewBuilder[IntKey, int]().NumShards(buckets).Capacity(1024).Build()
+			for i := 0; i < 1024; i++ {
+				cache.Set(IntKey(i), i)
+			}
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Int()
+				for pb.Next() {
+					_, _ = cache.Get(IntKey(i % 1024))
+					i++
+				}
+			})
+		})
+	}
+}
@@ -1,10 +1,15 @@
 package ezcache
 
 import (
+	"context"
 	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/birdayz/ezcache/clocktest"
 	"gotest.tools/v3/assert"
 )
 
@@ -76,3 +81,1776 @@ func TestSetEvict(t *testing.T) {
 	}
 
 }
+
+func TestCacheLoaderSingleflight(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	cache := NewBuilder[StringKey, string]().Loader(func(key StringKey) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "loaded-" + string(key), nil
+	}).Capacity(10).NumShards(2).Build()
+
+	const callers = 50
+	var wg sync.WaitGroup
+	results := make([]string, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := cache.Get("key")
+			assert.NilError(t, err)
+			results[i] = res
+		}(i)
+	}
+
+	// Give the callers a chance to pile up behind the first load.
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+	for _, res := range results {
+		assert.Equal(t, res, "loaded-key")
+	}
+}
+
+func TestCacheLoaderSingleflightSharesError(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	cache := NewBuilder[StringKey, string]().Loader(func(key StringKey) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "", errors.New("backend down")
+	}).Capacity(10).NumShards(1).Build()
+
+	const callers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.Get("key")
+			assert.ErrorContains(t, err, "backend down")
+		}()
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+}
+
+func TestCacheLoaderSingleflightSameHashDifferentKeys(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	cache := NewBuilder[fake, string]().Loader(func(key fake) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return key.key, nil
+	}).Capacity(10).NumShards(1).Build()
+
+	var wg sync.WaitGroup
+	for _, k := range []fake{{"abc", 0}, {"def", 0}} {
+		wg.Add(1)
+		go func(k fake) {
+			defer wg.Done()
+			res, err := cache.Get(k)
+			assert.NilError(t, err)
+			assert.Equal(t, res, k.key)
+		}(k)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	// Keys with colliding hashes must not share a load.
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(2))
+}
+
+func TestCacheLoaderSupersededBySet(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cache := NewBuilder[StringKey, string]().Loader(func(key StringKey) (string, error) {
+		close(started)
+		<-release
+		return "loaded", nil
+	}).Capacity(10).NumShards(1).Build()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := cache.Get("key")
+		assert.NilError(t, err)
+		assert.Equal(t, res, "loaded")
+	}()
+
+	<-started
+	cache.Set("key", "set")
+	close(release)
+	<-done
+
+	// The value written by Set must not be overwritten by the older load.
+	res, err := cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, "set")
+}
+
+type ctxKey struct{}
+
+func TestCacheGetCtxPassesValues(t *testing.T) {
+	cache := NewBuilder[StringKey, string]().LoaderCtx(func(ctx context.Context, key StringKey) (string, error) {
+		return ctx.Value(ctxKey{}).(string), nil
+	}).Capacity(10).NumShards(1).Build()
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "trace-id")
+	res, err := cache.GetCtx(ctx, "key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, "trace-id")
+}
+
+func TestCacheGetCtxCancelledWaiterDoesNotAbortLoad(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cache := NewBuilder[StringKey, string]().LoaderCtx(func(ctx context.Context, key StringKey) (string, error) {
+		close(started)
+		select {
+		case <-release:
+			return "loaded", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}).Capacity(10).NumShards(1).Build()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := cache.GetCtx(context.Background(), "key")
+		assert.NilError(t, err)
+		assert.Equal(t, res, "loaded")
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan struct{})
+	go func() {
+		defer close(cancelled)
+		_, err := cache.GetCtx(ctx, "key")
+		assert.Equal(t, err, context.Canceled)
+	}()
+
+	cancel()
+	<-cancelled
+
+	close(release)
+	<-done
+}
+
+func TestCacheGetCtxDeadlineReachesLoader(t *testing.T) {
+	loaderDeadline := make(chan time.Time, 1)
+	loaderErr := make(chan error, 1)
+	cache := NewBuilder[StringKey, string]().LoaderCtx(func(ctx context.Context, key StringKey) (string, error) {
+		deadline, _ := ctx.Deadline()
+		loaderDeadline <- deadline
+		<-ctx.Done()
+		loaderErr <- ctx.Err()
+		return "", ctx.Err()
+	}).Capacity(10).NumShards(1).Build()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	// The load may fail with the deadline before the caller notices it.
+	_, err := cache.GetCtx(ctx, "key")
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+
+	// The loader runs with the deadline of the only waiter.
+	assert.Equal(t, <-loaderDeadline, deadline)
+	assert.Equal(t, <-loaderErr, context.DeadlineExceeded)
+}
+
+func TestCacheGetCtxAbandonedLoadIsNotJoined(t *testing.T) {
+	var calls int32
+	started := make(chan struct{}, 1)
+	cache := NewBuilder[StringKey, string]().LoaderCtx(func(ctx context.Context, key StringKey) (string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			started <- struct{}{}
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return "value", nil
+	}).Capacity(10).NumShards(1).Build()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := cache.GetCtx(ctx, "key")
+	assert.Equal(t, err, context.Canceled)
+
+	// The only waiter gave up, so the next miss starts a new load instead of
+	// failing with the cancelled one.
+	res, err := cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, "value")
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(2))
+
+	// Same for loads of GetAll.
+	ctx, cancel = context.WithCancel(context.Background())
+	atomic.StoreInt32(&calls, 0)
+	cache.Delete("key")
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err = cache.GetAllCtx(ctx, []StringKey{"key"})
+	assert.Equal(t, err, context.Canceled)
+	values, err := cache.GetAll([]StringKey{"key"})
+	assert.NilError(t, err)
+	res, _ = values.Get("key")
+	assert.Equal(t, res, "value")
+}
+
+func TestCacheGetCtxLoaderDeadlineFollowsWaiters(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loaderCtx := make(chan context.Context, 1)
+	cache := NewBuilder[StringKey, string]().LoaderCtx(func(ctx context.Context, key StringKey) (string, error) {
+		loaderCtx <- ctx
+		close(started)
+		<-release
+		return "value", nil
+	}).Capacity(10).NumShards(1).Build()
+
+	short, cancelShort := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelShort()
+	long, cancelLong := context.WithTimeout(context.Background(), time.Hour*2)
+	defer cancelLong()
+	longDeadline, _ := long.Deadline()
+
+	var wg sync.WaitGroup
+	get := func(ctx context.Context) {
+		defer wg.Done()
+		_, err := cache.GetCtx(ctx, "key")
+		assert.NilError(t, err)
+	}
+
+	wg.Add(1)
+	go get(short)
+	<-started
+	ctx := <-loaderCtx
+
+	// A waiter with a later deadline extends the one of the load.
+	wg.Add(1)
+	go get(long)
+	waitFor(t, func() bool {
+		deadline, _ := ctx.Deadline()
+		return deadline.Equal(longDeadline)
+	})
+
+	// A waiter without a deadline removes it.
+	wg.Add(1)
+	go get(context.Background())
+	waitFor(t, func() bool {
+		_, ok := ctx.Deadline()
+		return !ok
+	})
+
+	close(release)
+	wg.Wait()
+}
+
+func TestCacheGetAllBulkLoader(t *testing.T) {
+	var calls int32
+	var requested []IntKey
+	cache := NewBuilder[IntKey, int]().BulkLoader(func(ctx context.Context, keys []IntKey) (*HashMap[IntKey, int], error) {
+		atomic.AddInt32(&calls, 1)
+		requested = keys
+		res := NewHashMap[IntKey, int](len(keys))
+		for _, k := range keys {
+			// Pretend odd keys don't exist in the backend
+			if k%2 == 0 {
+				res.Set(k, int(k)*10)
+			}
+		}
+		return res, nil
+	}).Capacity(100).NumShards(4).Build()
+
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+
+	res, err := cache.GetAll([]IntKey{1, 2, 3, 4, 5, 6})
+	assert.NilError(t, err)
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+	assert.Equal(t, len(requested), 4)
+
+	for k, expected := range map[IntKey]int{1: 1, 2: 2, 4: 40, 6: 60} {
+		v, ok := res.Get(k)
+		assert.Equal(t, ok, true)
+		assert.Equal(t, v, expected)
+	}
+	for _, k := range []IntKey{3, 5} {
+		_, ok := res.Get(k)
+		assert.Equal(t, ok, false)
+	}
+
+	// Loaded values are cached
+	v, err := cache.Get(4)
+	assert.NilError(t, err)
+	assert.Equal(t, v, 40)
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+
+	// Get falls back to the bulk loader if there is no loader
+	_, err = cache.Get(7)
+	assert.Assert(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(2))
+}
+
+func TestCacheGetAllBulkLoaderError(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().BulkLoader(func(ctx context.Context, keys []IntKey) (*HashMap[IntKey, int], error) {
+		return nil, errors.New("backend down")
+	}).Capacity(100).NumShards(4).Build()
+
+	_, err := cache.GetAll([]IntKey{1, 2, 3})
+	assert.ErrorContains(t, err, "backend down")
+}
+
+func TestCacheGetAllLoader(t *testing.T) {
+	var calls int32
+	cache := NewBuilder[IntKey, int]().Loader(func(key IntKey) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		if key == 3 {
+			return 0, ErrNotFound
+		}
+		return int(key), nil
+	}).Capacity(100).NumShards(4).Build()
+
+	res, err := cache.GetAll([]IntKey{1, 2, 3})
+	assert.NilError(t, err)
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(3))
+
+	v, ok := res.Get(2)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, v, 2)
+	_, ok = res.Get(3)
+	assert.Equal(t, ok, false)
+}
+
+func TestCacheGetAllWithoutLoader(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().Capacity(100).NumShards(4).Build()
+	cache.Set(1, 1)
+
+	res, err := cache.GetAll([]IntKey{1, 2})
+	assert.NilError(t, err)
+
+	v, ok := res.Get(1)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, v, 1)
+	_, ok = res.Get(2)
+	assert.Equal(t, ok, false)
+}
+
+// readClock hides that the clock it wraps is an AdvancingClock, so that only
+// reads start refreshes.
+type readClock struct {
+	Clock
+}
+
+func TestCacheRefreshAfter(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	var calls int32
+	refreshing := make(chan struct{})
+	release := make(chan struct{})
+	cache := NewBuilder[StringKey, int]().Clock(readClock{clock}).Loader(func(key StringKey) (int, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n > 1 {
+			close(refreshing)
+			<-release
+		}
+		return int(n), nil
+	}).RefreshAfter(time.Millisecond * 10).TTL(time.Hour).Capacity(10).NumShards(1).Build()
+
+	res, err := cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, 1)
+
+	clock.Advance(time.Millisecond * 11)
+
+	// The stale value is returned immediately, while a refresh is started.
+	res, err = cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, 1)
+	<-refreshing
+
+	// Only a single refresh runs at a time.
+	res, err = cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, 1)
+
+	close(release)
+	waitFor(t, func() bool {
+		res, err := cache.Get("key")
+		return err == nil && res == 2
+	})
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(2))
+}
+
+func TestCacheRefreshAfterError(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	var calls int32
+	refreshErrors := make(chan error, 1)
+	cache := NewBuilder[StringKey, int]().Clock(clock).Loader(func(key StringKey) (int, error) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			return 0, errors.New("backend down")
+		}
+		return 1, nil
+	}).RefreshAfter(time.Millisecond * 10).OnRefreshError(func(key StringKey, err error) {
+		refreshErrors <- err
+	}).TTL(time.Hour).Capacity(10).NumShards(1).Build()
+
+	_, err := cache.Get("key")
+	assert.NilError(t, err)
+
+	// The refresh fails while advancing.
+	clock.Advance(time.Millisecond * 11)
+	assert.ErrorContains(t, <-refreshErrors, "backend down")
+
+	// The old value is kept, and refreshed again on the next read.
+	res, err := cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, 1)
+	assert.ErrorContains(t, <-refreshErrors, "backend down")
+}
+
+// waitFor polls cond until it returns true, or fails the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheRefreshWithReloader(t *testing.T) {
+	var olds []string
+	cache := NewBuilder[StringKey, string]().Loader(func(key StringKey) (string, error) {
+		return "loaded", nil
+	}).Reloader(func(ctx context.Context, key StringKey, old string) (string, error) {
+		olds = append(olds, old)
+		return old + "-reloaded", nil
+	}).Capacity(10).NumShards(1).Build()
+
+	// Keys that are not cached are loaded with the loader
+	err := cache.Refresh("key")
+	assert.NilError(t, err)
+	res, err := cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, "loaded")
+
+	err = cache.Refresh("key")
+	assert.NilError(t, err)
+	res, err = cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, "loaded-reloaded")
+	assert.DeepEqual(t, olds, []string{"loaded"})
+}
+
+func TestCacheRefreshUnchanged(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	cache := NewBuilder[StringKey, string]().Clock(clock).Reloader(func(ctx context.Context, key StringKey, old string) (string, error) {
+		return "", ErrUnchanged
+	}).TTL(time.Millisecond * 10).Capacity(10).NumShards(1).Build()
+
+	cache.Set("key", "value")
+
+	clock.Advance(time.Millisecond * 5)
+	err := cache.Refresh("key")
+	assert.NilError(t, err)
+
+	// Without the refresh, the entry would be expired by now
+	clock.Advance(time.Millisecond * 6)
+	res, err := cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, "value")
+}
+
+func TestCacheRefreshError(t *testing.T) {
+	cache := NewBuilder[StringKey, string]().Reloader(func(ctx context.Context, key StringKey, old string) (string, error) {
+		return "", errors.New("backend down")
+	}).Capacity(10).NumShards(1).Build()
+
+	cache.Set("key", "value")
+
+	err := cache.Refresh("key")
+	assert.ErrorContains(t, err, "backend down")
+
+	res, err := cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, "value")
+
+	err = cache.Refresh("missing")
+	assert.Equal(t, err, ErrNotFound)
+}
+
+func TestCacheRefreshAfterUsesReloader(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	cache := NewBuilder[StringKey, int]().Clock(clock).Loader(func(key StringKey) (int, error) {
+		return 1, nil
+	}).Reloader(func(ctx context.Context, key StringKey, old int) (int, error) {
+		return old + 1, nil
+	}).RefreshAfter(time.Millisecond * 10).TTL(time.Hour).Capacity(10).NumShards(1).Build()
+
+	res, err := cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, 1)
+
+	// Advancing the clock refreshes the entry before it returns.
+	clock.Advance(time.Millisecond * 11)
+	res, err = cache.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, res, 2)
+}
+
+type token struct {
+	value     string
+	expiresIn time.Duration
+}
+
+type tokenExpiry struct {
+	readExtension time.Duration
+}
+
+func (e tokenExpiry) ExpireAfterCreate(key StringKey, value token) time.Duration {
+	return value.expiresIn
+}
+
+func (e tokenExpiry) ExpireAfterUpdate(key StringKey, value token, currentDuration time.Duration) time.Duration {
+	return value.expiresIn
+}
+
+func (e tokenExpiry) ExpireAfterRead(key StringKey, value token, currentDuration time.Duration) time.Duration {
+	if e.readExtension > 0 {
+		return e.readExtension
+	}
+	return currentDuration
+}
+
+func TestCacheExpiry(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	cache := NewBuilder[StringKey, token]().Clock(clock).Loader(func(key StringKey) (token, error) {
+		return token{value: "loaded", expiresIn: time.Millisecond * 20}, nil
+	}).Expiry(tokenExpiry{}).TTL(time.Hour).Capacity(10).NumShards(1).Build()
+
+	cache.Set("short", token{value: "short", expiresIn: time.Millisecond * 5})
+	cache.Set("long", token{value: "long", expiresIn: time.Millisecond * 50})
+	_, err := cache.Get("loaded")
+	assert.NilError(t, err)
+
+	clock.Advance(time.Millisecond * 10)
+	_, found := cache.getShard(StringKey("short").HashCode()).get("short", StringKey("short").HashCode())
+	assert.Equal(t, found, false)
+
+	res, err := cache.Get("loaded")
+	assert.NilError(t, err)
+	assert.Equal(t, res.value, "loaded")
+
+	clock.Advance(time.Millisecond * 10)
+	_, found = cache.getShard(StringKey("loaded").HashCode()).get("loaded", StringKey("loaded").HashCode())
+	assert.Equal(t, found, false)
+
+	res, err = cache.Get("long")
+	assert.NilError(t, err)
+	assert.Equal(t, res.value, "long")
+}
+
+func TestCacheExpiryAfterRead(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	cache := NewBuilder[StringKey, token]().Clock(clock).Expiry(tokenExpiry{readExtension: time.Millisecond * 10}).Capacity(10).NumShards(1).Build()
+	cache.Set("key", token{value: "value", expiresIn: time.Millisecond * 10})
+
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Millisecond * 5)
+		_, err := cache.Get("key")
+		assert.NilError(t, err)
+	}
+
+	clock.Advance(time.Millisecond * 10)
+	_, err := cache.Get("key")
+	assert.Equal(t, err, ErrNotFound)
+}
+
+func TestCacheSetWithTTL(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	cache := NewBuilder[StringKey, string]().Clock(clock).TTL(time.Millisecond * 10).Capacity(10).NumShards(1).Build()
+	cache.SetWithTTL("short", "value", time.Millisecond*5)
+	cache.SetWithTTL("long", "value", time.Millisecond*20)
+	cache.SetWithTTL("forever", "value", 0)
+	cache.Set("default", "value")
+
+	clock.Advance(time.Millisecond * 5)
+	_, err := cache.Get("short")
+	assert.Equal(t, err, ErrNotFound)
+	_, err = cache.Get("default")
+	assert.NilError(t, err)
+
+	clock.Advance(time.Millisecond * 5)
+	_, err = cache.Get("default")
+	assert.Equal(t, err, ErrNotFound)
+	_, err = cache.Get("long")
+	assert.NilError(t, err)
+
+	clock.Advance(time.Hour * 24 * 365)
+	_, err = cache.Get("long")
+	assert.Equal(t, err, ErrNotFound)
+	_, err = cache.Get("forever")
+	assert.NilError(t, err)
+}
+
+func TestCacheUnboundedWithoutTTL(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().Capacity(0).TTL(0).NumShards(4).Build()
+	for i := 0; i < 10000; i++ {
+		cache.Set(IntKey(i), i)
+	}
+
+	for i := 0; i < 10000; i++ {
+		res, err := cache.Get(IntKey(i))
+		assert.NilError(t, err)
+		assert.Equal(t, res, i)
+	}
+
+	for _, shard := range cache.shards {
+		assert.Assert(t, shard.ttls == nil)
+		assert.Assert(t, shard.policy == nil)
+	}
+}
+
+type removalEvent struct {
+	Key   IntKey
+	Value int
+	Cause RemovalCause
+}
+
+func TestCacheRemovalListener(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	var events []removalEvent
+	cache := NewBuilder[IntKey, int]().Clock(clock).RemovalListener(func(key IntKey, value int, cause RemovalCause) {
+		events = append(events, removalEvent{key, value, cause})
+	}).TTL(time.Millisecond * 10).Capacity(2).NumShards(1).Build()
+
+	cache.Set(1, 1)
+	cache.Set(1, 2)
+	cache.Set(2, 2)
+	cache.Set(3, 3) // capacity per shard is 3
+	clock.Advance(time.Millisecond)
+	cache.Set(4, 4)
+	cache.Delete(2)
+	cache.Delete(2)
+
+	clock.Advance(time.Millisecond * 10)
+	_, _ = cache.Get(3)
+
+	assert.DeepEqual(t, events, []removalEvent{
+		{1, 1, RemovalReplaced},
+		{1, 2, RemovalEvicted},
+		{2, 2, RemovalExplicit},
+		{3, 3, RemovalExpired},
+		{4, 4, RemovalExpired},
+	})
+}
+
+func TestCacheRemovalListenerOutsideLock(t *testing.T) {
+	var cache *Cache[IntKey, int]
+	var events []removalEvent
+	cache = NewBuilder[IntKey, int]().RemovalListenerOutsideLock(func(key IntKey, value int, cause RemovalCause) {
+		// Accessing the cache from the listener must not deadlock.
+		_, _ = cache.Get(key)
+		events = append(events, removalEvent{key, value, cause})
+	}).Capacity(10).NumShards(1).Build()
+
+	cache.Set(1, 1)
+	cache.Set(1, 2)
+	cache.Delete(1)
+
+	assert.DeepEqual(t, events, []removalEvent{
+		{1, 1, RemovalReplaced},
+		{1, 2, RemovalExplicit},
+	})
+}
+
+func TestCacheMaxWeight(t *testing.T) {
+	var events []removalEvent
+	cache := NewBuilder[IntKey, int]().RemovalListener(func(key IntKey, value int, cause RemovalCause) {
+		events = append(events, removalEvent{key, value, cause})
+	}).Weigher(func(key IntKey, value int) uint64 {
+		return uint64(value)
+	}).MaxWeight(10).Capacity(0).NumShards(1).RecordStats().Build()
+
+	cache.Set(1, 4)
+	cache.Set(2, 4)
+	assert.Equal(t, cache.Weight(), uint64(8))
+
+	// Evicts entries in LRU order until the new entry fits.
+	_, _ = cache.Get(1)
+	cache.Set(3, 6)
+	assert.Equal(t, cache.Weight(), uint64(10))
+	_, err := cache.Get(2)
+	assert.Equal(t, err, ErrNotFound)
+
+	// Growing an entry evicts others as well.
+	cache.Set(3, 7)
+	assert.Equal(t, cache.Weight(), uint64(7))
+	_, err = cache.Get(1)
+	assert.Equal(t, err, ErrNotFound)
+
+	// Entries heavier than the whole shard are rejected, and evict the
+	// previous value.
+	cache.Set(3, 11)
+	assert.Equal(t, cache.Weight(), uint64(0))
+	_, err = cache.Get(3)
+	assert.Equal(t, err, ErrNotFound)
+
+	assert.DeepEqual(t, events, []removalEvent{
+		{2, 4, RemovalEvicted},
+		{3, 6, RemovalReplaced},
+		{1, 4, RemovalEvicted},
+		{3, 7, RemovalEvicted},
+		{3, 11, RemovalEvicted},
+	})
+	assert.Equal(t, cache.Stats().Evictions, uint64(4))
+}
+
+func TestCacheWeightWithoutWeigher(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().Capacity(0).MaxWeight(8).NumShards(4).Build()
+	for i := 0; i < 100; i++ {
+		cache.Set(IntKey(i), i)
+	}
+
+	// Every entry weighs 1, and each shard may hold 2 of them.
+	assert.Equal(t, cache.Weight(), uint64(8))
+}
+
+func TestCacheGlobalCapacity(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().Capacity(100).NumShards(64).GlobalCapacity().Build()
+
+	// All keys map to the same shard, which may use the whole capacity.
+	for i := 0; i < 1000; i++ {
+		cache.Set(IntKey(i*64), i)
+		assert.Assert(t, cache.Len() <= 100)
+	}
+	assert.Equal(t, cache.Len(), 100)
+
+	// The least recently used entries were evicted.
+	for i := 900; i < 1000; i++ {
+		res, err := cache.Get(IntKey(i * 64))
+		assert.NilError(t, err)
+		assert.Equal(t, res, i)
+	}
+
+	// Entries of other shards are evicted to make room.
+	for i := 0; i < 1000; i++ {
+		cache.Set(IntKey(i), i)
+		assert.Assert(t, cache.Len() <= 100)
+	}
+	assert.Equal(t, cache.Len(), 100)
+}
+
+func TestCacheGlobalCapacityConcurrent(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().Capacity(100).NumShards(8).GlobalCapacity().LoaderCtx(func(ctx context.Context, key IntKey) (int, error) {
+		return int(key), nil
+	}).Build()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 5000; i++ {
+				key := IntKey(r.Intn(1000))
+				switch r.Intn(3) {
+				case 0:
+					cache.Set(key, int(key))
+				case 1:
+					cache.Delete(key)
+				default:
+					res, err := cache.Get(key)
+					assert.NilError(t, err)
+					assert.Equal(t, res, int(key))
+				}
+				assert.Assert(t, cache.Len() <= 100)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	length := 0
+	for _, shard := range cache.shards {
+		length += shard.Len()
+	}
+	assert.Equal(t, cache.Len(), length)
+	assert.Equal(t, cache.shards[0].global.entries, int64(length))
+}
+
+// customPolicy hides the optional methods of the policy it wraps, like a
+// policy written against EvictionPolicy only.
+type customPolicy struct {
+	EvictionPolicy[IntKey]
+}
+
+func TestCacheGlobalCapacityCustomPolicy(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().EvictionPolicy(func(capacity int) EvictionPolicy[IntKey] {
+		return customPolicy{NewLRUPolicy[IntKey](capacity)}
+	}).Capacity(10).NumShards(4).GlobalCapacity().Build()
+
+	// Without PeekVictim, victims can't be compared across shards, but the
+	// capacity still holds.
+	for i := 0; i < 100; i++ {
+		cache.Set(IntKey(i), i)
+		assert.Assert(t, cache.Len() <= 10)
+	}
+	assert.Equal(t, cache.Len(), 10)
+}
+
+func TestCacheGlobalMaxWeight(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().Weigher(func(key IntKey, value int) uint64 {
+		return uint64(value)
+	}).MaxWeight(100).Capacity(0).NumShards(16).GlobalCapacity().Build()
+
+	for i := 0; i < 1000; i++ {
+		cache.Set(IntKey(i), i%20)
+		assert.Assert(t, cache.Weight() <= 100)
+	}
+
+	// Too heavy for the whole cache.
+	cache.Set(1, 101)
+	_, err := cache.Get(1)
+	assert.Equal(t, err, ErrNotFound)
+	assert.Equal(t, cache.Weight(), cache.shards[0].global.weight)
+}
+
+func TestCacheJanitor(t *testing.T) {
+	var expired int32
+	cache := NewBuilder[IntKey, int]().RemovalListener(func(key IntKey, value int, cause RemovalCause) {
+		if cause == RemovalExpired {
+			atomic.AddInt32(&expired, 1)
+		}
+	}).TTL(time.Millisecond * 10).Janitor(time.Millisecond).Capacity(0).NumShards(4).Build()
+	defer cache.Close()
+
+	for i := 0; i < 1000; i++ {
+		cache.Set(IntKey(i), i)
+	}
+
+	// Nobody touches the cache, but all entries are removed.
+	waitFor(t, func() bool { return cache.Len() == 0 })
+	assert.Equal(t, atomic.LoadInt32(&expired), int32(1000))
+
+	cache.Close()
+	cache.Close()
+}
+
+func TestCacheClockAdvanceExpires(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	var events []removalEvent
+	cache := NewBuilder[IntKey, int]().Clock(clock).RemovalListener(func(key IntKey, value int, cause RemovalCause) {
+		events = append(events, removalEvent{key, value, cause})
+	}).TTL(time.Second).NumShards(4).Build()
+	defer cache.Close()
+
+	cache.Set(1, 1)
+	clock.Advance(time.Millisecond * 500)
+	cache.Set(2, 2)
+
+	// Entries are removed while advancing, without accessing the cache.
+	clock.Advance(time.Millisecond * 500)
+	assert.DeepEqual(t, events, []removalEvent{{1, 1, RemovalExpired}})
+	assert.Equal(t, cache.Len(), 1)
+
+	// Closing unsubscribes from the clock.
+	cache.Close()
+	clock.Advance(time.Second)
+	assert.Equal(t, cache.Len(), 1)
+}
+
+func TestCacheClockAdvanceRefreshes(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	var reloads int32
+	cache := NewBuilder[IntKey, int]().Clock(clock).Loader(func(key IntKey) (int, error) {
+		return int(key), nil
+	}).Reloader(func(ctx context.Context, key IntKey, old int) (int, error) {
+		// Advance waits for slow refreshes as well.
+		time.Sleep(time.Millisecond * 10)
+		atomic.AddInt32(&reloads, 1)
+		return old + 10, nil
+	}).RefreshAfter(time.Second).NumShards(4).Build()
+	defer cache.Close()
+
+	_, err := cache.Get(1)
+	assert.NilError(t, err)
+	clock.Advance(time.Millisecond * 500)
+	_, err = cache.Get(2)
+	assert.NilError(t, err)
+
+	// Only 1 is due, and refreshed once Advance returns, without reading it.
+	clock.Advance(time.Millisecond * 500)
+	assert.Equal(t, atomic.LoadInt32(&reloads), int32(1))
+	res, _ := cache.Peek(1)
+	assert.Equal(t, res, 11)
+	res, _ = cache.Peek(2)
+	assert.Equal(t, res, 2)
+
+	clock.Advance(time.Millisecond * 500)
+	assert.Equal(t, atomic.LoadInt32(&reloads), int32(2))
+	res, _ = cache.Peek(2)
+	assert.Equal(t, res, 12)
+
+	// Closing unsubscribes from the clock.
+	cache.Close()
+	clock.Advance(time.Second)
+	assert.Equal(t, atomic.LoadInt32(&reloads), int32(2))
+}
+
+func TestCacheClockBackwards(t *testing.T) {
+	start := time.Now()
+	clock := clocktest.NewClock(start)
+	cache := NewBuilder[IntKey, int]().Clock(clock).TTL(time.Second).NumShards(1).Build()
+	defer cache.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		cache.Set(1, 1)
+		clock.Advance(time.Hour)
+		clock.Set(start)
+		cache.Set(2, 2)
+		clock.Advance(time.Millisecond)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("cleaning up after the clock went backwards did not finish")
+	}
+
+	// 1 expired while the clock was ahead, 2 did not expire yet.
+	_, err := cache.Get(1)
+	assert.Equal(t, err, ErrNotFound)
+	res, err := cache.Get(2)
+	assert.NilError(t, err)
+	assert.Equal(t, res, 2)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, cache.Len(), 0)
+}
+
+func TestCoarseClock(t *testing.T) {
+	clock := CoarseClock()
+
+	start := clock.Now()
+	assert.Assert(t, time.Since(start) < time.Second)
+	waitFor(t, func() bool { return clock.Now().After(start) })
+}
+
+func TestCacheStats(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	cache := NewBuilder[IntKey, int]().Loader(func(key IntKey) (int, error) {
+		if key < 0 {
+			return 0, errors.New("negative key")
+		}
+		return int(key), nil
+	}).Capacity(1).NumShards(1).TTL(time.Second).Clock(clock).RecordStats().Build()
+	defer cache.Close()
+
+	_, err := cache.Get(1)
+	assert.NilError(t, err)
+	_, err = cache.Get(1)
+	assert.NilError(t, err)
+	_, err = cache.Get(-1)
+	assert.Assert(t, err != nil)
+
+	stats := cache.Stats()
+	assert.Equal(t, stats.Hits, uint64(1))
+	assert.Equal(t, stats.Misses, uint64(2))
+	assert.Equal(t, stats.LoadSuccesses, uint64(1))
+	assert.Equal(t, stats.LoadFailures, uint64(1))
+	assert.Equal(t, stats.LoadFailureRatio(), 0.5)
+	assert.Equal(t, stats.AverageLoadPenalty(), stats.TotalLoadTime/2)
+
+	var loads uint64
+	for _, n := range stats.LoadTimes {
+		loads += n
+	}
+	assert.Equal(t, loads, stats.Loads())
+
+	// The shard holds two entries, so 1 is evicted.
+	cache.Set(2, 2)
+	cache.Set(3, 3)
+	clock.Advance(time.Second)
+	_, err = cache.Get(2)
+	assert.NilError(t, err)
+
+	delta := cache.Stats().Minus(stats)
+	assert.DeepEqual(t, delta, Stats{
+		Misses:        1,
+		LoadSuccesses: 1,
+		TotalLoadTime: delta.TotalLoadTime,
+		LoadTimes:     delta.LoadTimes,
+		Evictions:     1,
+		Expirations:   2,
+	})
+	assert.Equal(t, delta.HitRatio(), 0.0)
+	assert.Equal(t, delta.MissRatio(), 1.0)
+}
+
+func TestCacheStatsDisabled(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().Build()
+
+	cache.Set(1, 1)
+	_, err := cache.Get(1)
+	assert.NilError(t, err)
+
+	stats := cache.Stats()
+	assert.DeepEqual(t, stats, Stats{})
+	assert.Equal(t, stats.HitRatio(), 1.0)
+	assert.Equal(t, stats.AverageLoadPenalty(), time.Duration(0))
+}
+
+type recordingInstrumentation struct {
+	mu      sync.Mutex
+	gets    []GetResult
+	loads   []LoadInfo
+	loadErr []error
+}
+
+type instrumentationCtxKey struct{}
+
+func (r *recordingInstrumentation) StartGet(ctx context.Context, info GetInfo) (context.Context, func(GetResult)) {
+	return context.WithValue(ctx, instrumentationCtxKey{}, info.KeyHash), func(result GetResult) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.gets = append(r.gets, result)
+	}
+}
+
+func (r *recordingInstrumentation) StartLoad(ctx context.Context, info LoadInfo) (context.Context, func(error)) {
+	r.mu.Lock()
+	r.loads = append(r.loads, info)
+	r.mu.Unlock()
+
+	return ctx, func(err error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.loadErr = append(r.loadErr, err)
+	}
+}
+
+func TestCacheInstrumentation(t *testing.T) {
+	instrumentation := &recordingInstrumentation{}
+	release := make(chan struct{})
+	var loaderCtxValue interface{}
+	cache := NewBuilder[IntKey, int]().LoaderCtx(func(ctx context.Context, key IntKey) (int, error) {
+		loaderCtxValue = ctx.Value(instrumentationCtxKey{})
+		<-release
+		return int(key), nil
+	}).NumShards(4).Instrumentation(instrumentation).Build()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.Get(5)
+			assert.NilError(t, err)
+		}()
+	}
+	waitFor(t, func() bool {
+		shard := cache.getShard(5)
+		shard.lock()
+		defer shard.unlock()
+		c, ok := shard.loads.Get(5)
+		return ok && c.waiters == 2
+	})
+	close(release)
+	wg.Wait()
+
+	_, err := cache.Get(5)
+	assert.NilError(t, err)
+
+	// The loader runs with the context returned by StartGet.
+	assert.Equal(t, loaderCtxValue, uint64(5))
+	assert.DeepEqual(t, instrumentation.loads, []LoadInfo{{KeyHash: 5, Shard: 1, Keys: 1}})
+	assert.DeepEqual(t, instrumentation.loadErr, []error{nil})
+	assert.Equal(t, len(instrumentation.gets), 3)
+	assert.Equal(t, instrumentation.gets[2], GetResult{Hit: true})
+
+	// One of the concurrent lookups started the load, the other shared it.
+	shared := 0
+	for _, result := range instrumentation.gets[:2] {
+		assert.Assert(t, !result.Hit)
+		if result.Shared {
+			shared++
+		}
+	}
+	assert.Equal(t, shared, 1)
+}
+
+func TestCacheRange(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	cache := NewBuilder[IntKey, int]().NumShards(4).Clock(clock).Build()
+	for i := 0; i < 10; i++ {
+		cache.Set(IntKey(i), i)
+	}
+	cache.SetWithTTL(10, 10, time.Second)
+	clock.Advance(time.Second)
+
+	// Expired entries are skipped, and the cache can be used from fn.
+	seen := make(map[IntKey]int)
+	cache.Range(func(key IntKey, value int) bool {
+		seen[key] = value
+		cache.Delete(key)
+		return true
+	})
+	assert.Equal(t, len(seen), 10)
+	for key, value := range seen {
+		assert.Equal(t, int(key), value)
+	}
+	assert.Equal(t, cache.Len(), 0)
+
+	for i := 0; i < 10; i++ {
+		cache.Set(IntKey(i), i)
+	}
+	visited := 0
+	cache.Range(func(IntKey, int) bool {
+		visited++
+		return visited < 3
+	})
+	assert.Equal(t, visited, 3)
+
+	keys := cache.Keys()
+	values := cache.Values()
+	assert.Equal(t, len(keys), 10)
+	assert.Equal(t, len(values), 10)
+	sum := 0
+	for i := range keys {
+		sum += int(keys[i]) - values[i]
+	}
+	assert.Equal(t, sum, 0)
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	cache := NewBuilder[IntKey, int]().NumShards(4).Clock(clock).Build()
+	for i := 0; i < 10; i++ {
+		cache.Set(IntKey(i), i)
+	}
+	cache.SetWithTTL(10, 10, time.Second)
+	clock.Advance(time.Second)
+
+	snapshot := cache.Snapshot()
+	assert.Equal(t, snapshot.Len(), 10)
+	for i := 0; i < 10; i++ {
+		value, ok := snapshot.Get(IntKey(i))
+		assert.Equal(t, ok, true)
+		assert.Equal(t, value, i)
+	}
+
+	// The snapshot is a copy.
+	cache.Set(0, 100)
+	value, _ := snapshot.Get(0)
+	assert.Equal(t, value, 0)
+
+	assert.Equal(t, NewBuilder[IntKey, int]().Build().Snapshot().Len(), 0)
+}
+
+func TestCacheSnapshotConcurrent(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().NumShards(8).Build()
+
+	// Pairs of keys are always written together, but to different shards.
+	var stop int32
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+			cache.Set(IntKey(i%100), i)
+			cache.Set(IntKey(i%100+1000), i)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		snapshot := cache.Snapshot()
+		snapshot.Range(func(key IntKey, value int) bool {
+			if key >= 1000 {
+				return true
+			}
+			// The second key of a pair is written after the first, so it
+			// is never newer.
+			other, ok := snapshot.Get(key + 1000)
+			if ok {
+				assert.Assert(t, other <= value)
+			}
+			return true
+		})
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+}
+
+func TestCacheInvalidateAll(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	var events []removalEvent
+	cache := NewBuilder[IntKey, int]().RemovalListener(func(key IntKey, value int, cause RemovalCause) {
+		events = append(events, removalEvent{key, value, cause})
+	}).Capacity(10).NumShards(2).TTL(time.Second).Clock(clock).Build()
+	for i := 0; i < 4; i++ {
+		cache.Set(IntKey(i), i)
+	}
+
+	cache.InvalidateAll()
+	assert.Equal(t, cache.Len(), 0)
+	assert.Equal(t, len(events), 4)
+	for _, event := range events {
+		assert.Equal(t, event.Cause, RemovalExplicit)
+	}
+	_, err := cache.Get(0)
+	assert.Equal(t, err, ErrNotFound)
+
+	// The shards still evict and expire entries.
+	events = nil
+	for i := 0; i < 20; i++ {
+		cache.Set(IntKey(i), i)
+	}
+	assert.Assert(t, cache.Len() <= 12)
+	clock.Advance(time.Second)
+	assert.Equal(t, cache.Len(), 0)
+	for _, event := range events {
+		assert.Assert(t, event.Cause == RemovalEvicted || event.Cause == RemovalExpired)
+	}
+}
+
+func TestCacheClear(t *testing.T) {
+	notified := 0
+	cache := NewBuilder[IntKey, int]().RemovalListener(func(IntKey, int, RemovalCause) {
+		notified++
+	}).Capacity(10).MaxWeight(100).GlobalCapacity().NumShards(4).Build()
+	for i := 0; i < 10; i++ {
+		cache.Set(IntKey(i), i)
+	}
+
+	cache.Clear()
+	assert.Equal(t, notified, 0)
+	assert.Equal(t, cache.Len(), 0)
+	assert.Equal(t, cache.Weight(), uint64(0))
+
+	// The global budget was released, so the cache can be filled again
+	// without evicting.
+	for i := 0; i < 10; i++ {
+		cache.Set(IntKey(i), i)
+	}
+	assert.Equal(t, cache.Len(), 10)
+	assert.Equal(t, notified, 0)
+}
+
+func TestCacheClearInFlightLoad(t *testing.T) {
+	release := make(chan struct{})
+	cache := NewBuilder[IntKey, int]().Loader(func(key IntKey) (int, error) {
+		<-release
+		return int(key), nil
+	}).Build()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		value, err := cache.Get(1)
+		assert.Check(t, err)
+		assert.Check(t, value == 1)
+	}()
+	waitFor(t, func() bool {
+		shard := cache.getShard(1)
+		shard.lock()
+		defer shard.unlock()
+		_, ok := shard.loads.Get(1)
+		return ok
+	})
+
+	cache.Clear()
+	close(release)
+	<-done
+
+	// The load completed, but its result was not written.
+	assert.Equal(t, cache.Len(), 0)
+}
+
+func TestCacheInvalidateIf(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	var events []removalEvent
+	cache := NewBuilder[IntKey, int]().RemovalListener(func(key IntKey, value int, cause RemovalCause) {
+		events = append(events, removalEvent{key, value, cause})
+	}).NumShards(4).Clock(clock).Build()
+	for i := 0; i < 10; i++ {
+		cache.Set(IntKey(i), i)
+	}
+	cache.SetWithTTL(10, 10, time.Second)
+	clock.Advance(time.Second)
+	events = nil
+
+	removed := cache.InvalidateIf(func(key IntKey, value int) bool {
+		return value%2 == 0
+	})
+	assert.Equal(t, removed, 5)
+	assert.Equal(t, len(events), 5)
+	for _, event := range events {
+		assert.Equal(t, event.Value%2, 0)
+		assert.Equal(t, event.Cause, RemovalExplicit)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := cache.Get(IntKey(i))
+		assert.Equal(t, err == nil, i%2 == 1)
+	}
+}
+
+func TestCacheTags(t *testing.T) {
+	var events []removalEvent
+	cache := NewBuilder[IntKey, int]().RemovalListener(func(key IntKey, value int, cause RemovalCause) {
+		events = append(events, removalEvent{key, value, cause})
+	}).NumShards(4).Build()
+
+	cache.SetWithTags(1, 1, "product:42", "tenant:7")
+	cache.SetWithTags(2, 2, "product:42")
+	cache.SetWithTags(3, 3, "tenant:7")
+	// Set replaces the tags of the entry.
+	cache.SetWithTags(4, 4, "product:42")
+	cache.Set(4, 4)
+	events = nil
+
+	assert.Equal(t, cache.InvalidateTag("product:42"), 2)
+	assert.DeepEqual(t, events, []removalEvent{{1, 1, RemovalExplicit}, {2, 2, RemovalExplicit}})
+	assert.Equal(t, cache.Len(), 2)
+
+	// 1 was removed from the index of tenant:7 as well.
+	assert.Equal(t, cache.InvalidateTag("tenant:7"), 1)
+	assert.Equal(t, cache.InvalidateTag("tenant:7"), 0)
+	assert.Equal(t, cache.InvalidateTag("unknown"), 0)
+
+	_, err := cache.Get(4)
+	assert.NilError(t, err)
+}
+
+func TestCacheTagsFromLoader(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().LoaderCtx(func(ctx context.Context, key IntKey) (int, error) {
+		AddTags(ctx, "even")
+		if key%2 == 1 {
+			AddTags(ctx, "odd")
+		}
+		return int(key), nil
+	}).NumShards(4).Build()
+
+	for i := 0; i < 10; i++ {
+		_, err := cache.Get(IntKey(i))
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, cache.InvalidateTag("odd"), 5)
+	assert.Equal(t, cache.InvalidateTag("even"), 5)
+
+	// The refresh tags the entry again.
+	cache.Set(1, 1)
+	assert.NilError(t, cache.Refresh(1))
+	assert.Equal(t, cache.InvalidateTag("odd"), 1)
+
+	// Outside of a loader, AddTags does nothing.
+	AddTags(context.Background(), "ignored")
+}
+
+func TestCacheTagsKeptOnRefresh(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+
+	var mu sync.Mutex
+	var calls int
+	tag := "loaded"
+	setTag := func(t string) {
+		mu.Lock()
+		defer mu.Unlock()
+		tag = t
+	}
+	cache := NewBuilder[IntKey, int]().Clock(clock).LoaderCtx(func(ctx context.Context, key IntKey) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if tag != "" {
+			AddTags(ctx, tag)
+		}
+		return calls, nil
+	}).RefreshAfter(time.Millisecond * 10).NumShards(1).Build()
+	defer cache.Close()
+
+	_, err := cache.Get(1)
+	assert.NilError(t, err)
+	_, err = cache.Get(2)
+	assert.NilError(t, err)
+
+	// Neither the refreshes ahead nor an explicit refresh attach tags, so
+	// the entries keep their own.
+	setTag("")
+	clock.Advance(time.Millisecond * 11)
+	assert.NilError(t, cache.Refresh(2))
+	mu.Lock()
+	assert.Equal(t, calls, 5)
+	mu.Unlock()
+	assert.Equal(t, cache.InvalidateTag("loaded"), 2)
+
+	// Tags attached by a reload replace the ones of the entry.
+	cache.SetWithTags(3, 3, "set")
+	setTag("reloaded")
+	assert.NilError(t, cache.Refresh(3))
+	assert.Equal(t, cache.InvalidateTag("set"), 0)
+	assert.Equal(t, cache.InvalidateTag("reloaded"), 1)
+}
+
+func TestCacheTagsBulkLoader(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().BulkLoader(func(ctx context.Context, keys []IntKey) (*HashMap[IntKey, int], error) {
+		AddTags(ctx, "bulk")
+		values := NewHashMap[IntKey, int](len(keys) + 1)
+		for _, key := range keys {
+			values.Set(key, int(key))
+		}
+		return values, nil
+	}).NumShards(4).Build()
+
+	_, err := cache.GetAll([]IntKey{1, 2, 3})
+	assert.NilError(t, err)
+	assert.Equal(t, cache.InvalidateTag("bulk"), 3)
+}
+
+func TestCacheGetOrSet(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().Build()
+
+	actual, loaded := cache.GetOrSet(1, 1)
+	assert.Equal(t, actual, 1)
+	assert.Equal(t, loaded, false)
+	actual, loaded = cache.GetOrSet(1, 2)
+	assert.Equal(t, actual, 1)
+	assert.Equal(t, loaded, true)
+
+	assert.Equal(t, cache.SetIfAbsent(1, 3), false)
+	assert.Equal(t, cache.SetIfAbsent(2, 2), true)
+	value, err := cache.Get(2)
+	assert.NilError(t, err)
+	assert.Equal(t, value, 2)
+
+	previous, replaced := cache.Replace(3, 3)
+	assert.Equal(t, replaced, false)
+	assert.Equal(t, previous, 0)
+	assert.Equal(t, cache.Len(), 2)
+	previous, replaced = cache.Replace(1, 4)
+	assert.Equal(t, replaced, true)
+	assert.Equal(t, previous, 1)
+	value, err = cache.Get(1)
+	assert.NilError(t, err)
+	assert.Equal(t, value, 4)
+}
+
+func TestCacheCompute(t *testing.T) {
+	var events []removalEvent
+	cache := NewBuilder[IntKey, int]().RemovalListener(func(key IntKey, value int, cause RemovalCause) {
+		events = append(events, removalEvent{key, value, cause})
+	}).Build()
+
+	value, ok := cache.Compute(1, func(old int, ok bool) (int, Op) {
+		assert.Equal(t, ok, false)
+		return 0, OpKeep
+	})
+	assert.Equal(t, ok, false)
+	assert.Equal(t, cache.Len(), 0)
+
+	value, ok = cache.Compute(1, func(old int, ok bool) (int, Op) {
+		return old + 1, OpSet
+	})
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, 1)
+
+	value, ok = cache.ComputeIfPresent(1, func(old int) (int, Op) {
+		return old + 1, OpSet
+	})
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, 2)
+
+	_, ok = cache.ComputeIfPresent(2, func(old int) (int, Op) {
+		t.Fatal("fn called for absent key")
+		return 0, OpSet
+	})
+	assert.Equal(t, ok, false)
+
+	_, ok = cache.Compute(1, func(old int, ok bool) (int, Op) {
+		return 0, OpDelete
+	})
+	assert.Equal(t, ok, false)
+	assert.Equal(t, cache.Len(), 0)
+	assert.DeepEqual(t, events, []removalEvent{{1, 1, RemovalReplaced}, {1, 2, RemovalExplicit}})
+}
+
+func TestCacheMerge(t *testing.T) {
+	cache := NewBuilder[IntKey, []string]().NumShards(4).Build()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.Merge(IntKey(j%4), []string{"x"}, func(old, value []string) []string {
+					// Copy, so that readers of old are not affected.
+					return append(append([]string(nil), old...), value...)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		value, err := cache.Get(IntKey(i))
+		assert.NilError(t, err)
+		assert.Equal(t, len(value), 200)
+	}
+}
+
+// insertHookPolicy is an LRU policy that calls onInsert after an entry was
+// inserted, while the shard is still locked.
+type insertHookPolicy struct {
+	EvictionPolicy[IntKey]
+	onInsert func()
+}
+
+func (p insertHookPolicy) OnInsert(e *PolicyEntry[IntKey]) {
+	p.EvictionPolicy.OnInsert(e)
+	p.onInsert()
+}
+
+func TestCacheComputeGlobalCapacity(t *testing.T) {
+	// The capacity must hold at all times, not only once all writes are
+	// done, so it is checked right after each insert.
+	var exceeded int32
+	var cache *Cache[IntKey, int]
+	cache = NewBuilder[IntKey, int]().EvictionPolicy(func(capacity int) EvictionPolicy[IntKey] {
+		return insertHookPolicy{NewLRUPolicy[IntKey](capacity), func() {
+			if cache.Len() > 10 {
+				atomic.StoreInt32(&exceeded, 1)
+			}
+		}}
+	}).Capacity(10).GlobalCapacity().NumShards(4).Build()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := IntKey(i*1000 + j)
+				switch j % 4 {
+				case 0:
+					cache.Merge(key, 1, func(old, value int) int {
+						return old + value
+					})
+				case 1:
+					cache.GetOrSet(key, 1)
+				case 2:
+					cache.CompareAndSet(key, 0, 1)
+				case 3:
+					cache.Compute(key, func(old int, ok bool) (int, Op) {
+						return 1, OpSet
+					})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, atomic.LoadInt32(&exceeded), int32(0))
+	assert.Equal(t, cache.Len(), 10)
+}
+
+func TestCacheComputeGlobalMaxWeight(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().MaxWeight(100).Weigher(func(key IntKey, value int) uint64 {
+		return uint64(value)
+	}).GlobalCapacity().NumShards(4).Build()
+
+	for i := 0; i < 100; i++ {
+		cache.Compute(IntKey(i), func(old int, ok bool) (int, Op) {
+			return 10, OpSet
+		})
+	}
+	assert.Equal(t, cache.Len(), 10)
+
+	// Too heavy to ever fit, which gives the reserved room back.
+	_, ok := cache.Compute(1000, func(old int, ok bool) (int, Op) {
+		return 101, OpSet
+	})
+	assert.Equal(t, ok, false)
+	for i := 0; i < 10; i++ {
+		cache.Compute(IntKey(i), func(old int, ok bool) (int, Op) {
+			return 0, OpKeep
+		})
+	}
+	cache.GetOrSet(2000, 10)
+	assert.Equal(t, cache.Len(), 10)
+}
+
+func TestCacheCompareAndSet(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().RecordStats().Build()
+
+	_, version, err := cache.GetVersioned(1)
+	assert.Equal(t, err, ErrNotFound)
+	assert.Equal(t, version, uint64(0))
+
+	// Version 0 only sets absent keys.
+	assert.Equal(t, cache.CompareAndSet(1, 0, 1), true)
+	assert.Equal(t, cache.CompareAndSet(1, 0, 2), false)
+
+	value, version, err := cache.GetVersioned(1)
+	assert.NilError(t, err)
+	assert.Equal(t, value, 1)
+	assert.Assert(t, version > 0)
+
+	// A write in between makes the version stale.
+	cache.Set(1, 3)
+	assert.Equal(t, cache.CompareAndSet(1, version, 4), false)
+	value, newVersion, err := cache.GetVersioned(1)
+	assert.NilError(t, err)
+	assert.Equal(t, value, 3)
+	assert.Assert(t, newVersion > version)
+	assert.Equal(t, cache.CompareAndSet(1, newVersion, 4), true)
+
+	// Deleting and writing the key again does not reuse versions.
+	_, version, err = cache.GetVersioned(1)
+	assert.NilError(t, err)
+	cache.Delete(1)
+	cache.Set(1, 5)
+	assert.Equal(t, cache.CompareAndSet(1, version, 6), false)
+
+	stats := cache.Stats()
+	assert.Equal(t, stats.Hits, uint64(3))
+	assert.Equal(t, stats.Misses, uint64(1))
+}
+
+func TestCacheCompareAndSetConcurrent(t *testing.T) {
+	cache := NewBuilder[IntKey, int]().Loader(func(key IntKey) (int, error) {
+		return 0, nil
+	}).Build()
+
+	// Optimistic increments must not lose updates.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for {
+					value, version, err := cache.GetVersioned(1)
+					assert.Check(t, err)
+					if cache.CompareAndSet(1, version, value+1) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := cache.Get(1)
+	assert.NilError(t, err)
+	assert.Equal(t, value, 800)
+}
+
+func TestCachePeek(t *testing.T) {
+	loads := 0
+	cache := NewBuilder[IntKey, int]().Loader(func(key IntKey) (int, error) {
+		loads++
+		return int(key), nil
+	}).Capacity(1).NumShards(1).RecordStats().Build()
+
+	_, ok := cache.Peek(0)
+	assert.Equal(t, ok, false)
+	assert.Equal(t, loads, 0)
+
+	// The shard holds two entries. Peeking at 0 does not make it recently
+	// used, so it is evicted in favor of 1.
+	cache.Set(0, 0)
+	cache.Set(1, 1)
+	value, ok := cache.Peek(0)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, 0)
+	cache.Set(2, 2)
+	_, ok = cache.Peek(0)
+	assert.Equal(t, ok, false)
+	_, ok = cache.Peek(1)
+	assert.Equal(t, ok, true)
+
+	assert.DeepEqual(t, cache.Stats(), Stats{Evictions: 1})
+}
+
+func TestCacheGetEntry(t *testing.T) {
+	start := time.UnixMilli(time.Now().UnixMilli())
+	clock := clocktest.NewClock(start)
+	cache := NewBuilder[IntKey, int]().Weigher(func(key IntKey, value int) uint64 {
+		return uint64(value)
+	}).TTL(time.Hour).Clock(clock).Build()
+
+	_, ok := cache.GetEntry(1)
+	assert.Equal(t, ok, false)
+
+	cache.Set(1, 10)
+	clock.Advance(time.Second)
+	cache.Set(1, 20)
+	clock.Advance(time.Second)
+	for i := 0; i < 3; i++ {
+		_, err := cache.Get(1)
+		assert.NilError(t, err)
+	}
+	_, version, err := cache.GetVersioned(1)
+	assert.NilError(t, err)
+
+	info, ok := cache.GetEntry(1)
+	assert.Equal(t, ok, true)
+	assert.DeepEqual(t, info, EntryInfo[int]{
+		Value:      20,
+		Version:    version,
+		Weight:     20,
+		InsertedAt: start,
+		WrittenAt:  start.Add(time.Second),
+		AccessedAt: start.Add(2 * time.Second),
+		ExpiresAt:  start.Add(time.Second + time.Hour),
+		Hits:       4,
+	})
+
+	// GetEntry itself is no access.
+	clock.Advance(time.Second)
+	info, _ = cache.GetEntry(1)
+	assert.Equal(t, info.Hits, uint64(4))
+	assert.Equal(t, info.AccessedAt, start.Add(2*time.Second))
+
+	cache.Set(2, 2)
+	info, _ = cache.GetEntry(2)
+	assert.Assert(t, info.AccessedAt.IsZero())
+}
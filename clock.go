@@ -0,0 +1,71 @@
+package ezcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the cache what time it is. Replacing it lets tests control
+// when entries expire or are refreshed, see package clocktest.
+type Clock interface {
+	Now() time.Time
+}
+
+// AdvancingClock is a Clock that jumps forward, like a fake clock in tests.
+// Whenever the clock advanced, a cache using it removes the entries that
+// expired, and refreshes the entries that became due for a refresh, instead
+// of waiting for the next access. Both are done before OnAdvance's callback
+// returns, so loaders must not wait for the caller that advances the clock.
+type AdvancingClock interface {
+	Clock
+
+	// OnAdvance registers fn to be called every time the clock advanced,
+	// and returns a func that unregisters it.
+	OnAdvance(fn func()) (cancel func())
+}
+
+// systemClock is the default Clock, which calls time.Now.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Resolution of the clock returned by CoarseClock.
+const coarseClockResolution = time.Millisecond
+
+var (
+	coarseClockOnce sync.Once
+	coarse          *coarseClock
+)
+
+// CoarseClock returns a Clock that only ticks every millisecond. Reading it
+// is cheaper than calling time.Now, which caches call on most operations if
+// entries expire or are refreshed. The clock is shared by all caches, and
+// updated by a goroutine that is started on the first call and runs until
+// the process exits.
+func CoarseClock() Clock {
+	coarseClockOnce.Do(func() {
+		coarse = &coarseClock{now: time.Now().UnixNano()}
+		go coarse.run()
+	})
+
+	return coarse
+}
+
+type coarseClock struct {
+	// Accessed atomically.
+	now int64
+}
+
+func (c *coarseClock) Now() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.now))
+}
+
+func (c *coarseClock) run() {
+	ticker := time.NewTicker(coarseClockResolution)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		atomic.StoreInt64(&c.now, now.UnixNano())
+	}
+}
@@ -0,0 +1,94 @@
+// Package clocktest provides a fake clock, to control time in tests of code
+// that uses an ezcache.Cache.
+package clocktest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock that only moves when it is told to. It implements
+// ezcache.AdvancingClock, so a cache using it removes entries that expired,
+// and refreshes entries that are due for a refresh, as soon as the clock is
+// advanced.
+type Clock struct {
+	mu          sync.Mutex
+	now         time.Time
+	subscribers []subscriber
+	nextID      int
+}
+
+type subscriber struct {
+	id int
+	fn func()
+}
+
+// NewClock returns a clock set to now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{
+		now: now,
+	}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by d. Caches using the clock have removed
+// the entries that expired in the meantime, and refreshed the entries that
+// became due for a refresh, once Advance returns.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+
+	c.notify()
+}
+
+// Set sets the clock to t, which may also lie in the past.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	c.now = t
+	c.mu.Unlock()
+
+	c.notify()
+}
+
+// OnAdvance registers fn to be called synchronously every time the clock is
+// advanced or set, and returns a func that unregisters it.
+func (c *Clock) OnAdvance(fn func()) (cancel func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID
+	c.nextID++
+	c.subscribers = append(c.subscribers, subscriber{id, fn})
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		for i, s := range c.subscribers {
+			if s.id == id {
+				c.subscribers = append(c.subscribers[:i], c.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// notify calls all subscribers, without holding the lock, so they can read
+// the clock.
+func (c *Clock) notify() {
+	c.mu.Lock()
+	subscribers := append([]subscriber(nil), c.subscribers...)
+	c.mu.Unlock()
+
+	for _, s := range subscribers {
+		s.fn()
+	}
+}
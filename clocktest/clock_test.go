@@ -0,0 +1,31 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Now()
+	clock := NewClock(start)
+	assert.Equal(t, clock.Now(), start)
+
+	advanced := 0
+	cancel := clock.OnAdvance(func() {
+		// Reading the clock from a subscriber must not deadlock.
+		_ = clock.Now()
+		advanced++
+	})
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, clock.Now(), start.Add(time.Minute))
+	clock.Set(start)
+	assert.Equal(t, clock.Now(), start)
+	assert.Equal(t, advanced, 2)
+
+	cancel()
+	clock.Advance(time.Minute)
+	assert.Equal(t, advanced, 2)
+}
@@ -0,0 +1,143 @@
+package ezcache
+
+// Op tells Compute what to do with an entry.
+type Op int
+
+const (
+	// OpKeep leaves the entry as it is, or absent.
+	OpKeep Op = iota
+	// OpSet sets the entry to the computed value.
+	OpSet
+	// OpDelete removes the entry.
+	OpDelete
+)
+
+// compute atomically replaces the value of key with the one computed by fn
+// from the current value, and returns the value key has afterwards, and
+// whether it is present. fn and the weigher are called while the lock is
+// held. Like a Set, writing a value removes the entry's tags and forgets
+// loads of key that are in flight. The caller must not hold the lock.
+func (s *shard[K, V]) compute(key K, keyHash uint64, fn func(old V, ok bool) (V, Op)) (V, bool) {
+	// The weight of the value is not known yet, so only a slot is reserved.
+	s.reserve(0)
+	return s.computeEntry(key, keyHash, 0, false, func(entry *cacheEntry[K, V]) (V, Op) {
+		if entry == nil {
+			return fn(*new(V), false)
+		}
+		return fn(entry.value, true)
+	})
+}
+
+// computeValue is like compute, for fn that can only set key to value. Room
+// for value is reserved with its weight up front.
+func (s *shard[K, V]) computeValue(key K, keyHash uint64, value V, fn func(old V, ok bool) Op) (V, bool) {
+	weight := s.weigh(key, value)
+	s.reserve(weight)
+	return s.computeEntry(key, keyHash, weight, true, func(entry *cacheEntry[K, V]) (V, Op) {
+		if entry == nil {
+			return value, fn(*new(V), false)
+		}
+		return value, fn(entry.value, true)
+	})
+}
+
+// getVersioned returns the value of key and its version. Unlike get, it does
+// not record statistics. The caller must not hold the lock.
+func (s *shard[K, V]) getVersioned(key K, keyHash uint64) (value V, version uint64, found bool) {
+	s.lock()
+	defer s.unlock()
+
+	entry, ok := s.lookup(key, keyHash)
+	if !ok {
+		return *new(V), 0, false
+	}
+
+	s.onReadLocked(key, entry)
+	return entry.value, entry.version, true
+}
+
+// compareAndSet sets the value of key, if its version is the expected one.
+// Version 0 means that key is absent.
+func (s *shard[K, V]) compareAndSet(key K, keyHash uint64, expected uint64, value V) bool {
+	weight := s.weigh(key, value)
+	s.reserve(weight)
+
+	swapped := false
+	s.computeEntry(key, keyHash, weight, true, func(entry *cacheEntry[K, V]) (V, Op) {
+		var version uint64
+		if entry != nil {
+			version = entry.version
+		}
+		if version != expected {
+			return value, OpKeep
+		}
+
+		swapped = true
+		return value, OpSet
+	})
+
+	return swapped
+}
+
+// computeEntry is like compute, but passes the current entry to fn, or nil
+// if there is none. Room for the entry must have been reserved with reserve:
+// if weighed is true, with the weight of the value fn sets, otherwise with
+// zero weight. Room that is not used is given back.
+func (s *shard[K, V]) computeEntry(key K, keyHash uint64, weight uint64, weighed bool, fn func(entry *cacheEntry[K, V]) (V, Op)) (V, bool) {
+	reserved := weight
+	s.lock()
+
+	var old V
+	entry, ok := s.lookup(key, keyHash)
+	if ok {
+		old = entry.value
+	}
+
+	value, op := fn(entry)
+	switch op {
+	case OpKeep:
+		if ok {
+			s.onReadLocked(key, entry)
+		}
+		s.unlock()
+		s.unreserve(reserved)
+		return old, ok
+	case OpDelete:
+		if ok {
+			s.loads.DeleteH(key, keyHash)
+			s.delete(key)
+		}
+		s.unlock()
+		s.unreserve(reserved)
+		return *new(V), false
+	}
+
+	grown := false
+	if !weighed {
+		weight = s.weigh(key, value)
+		if s.global != nil && !s.tooHeavy(weight) {
+			// Evicting to make room for the weight would lock other
+			// shards, which must not happen while this one is locked.
+			// Take it now, and evict once the lock is released.
+			s.global.grow(weight)
+			grown = true
+		}
+	}
+	s.storeWithTTL(key, keyHash, value, weight, useDefaultTTL, nil)
+	s.loads.DeleteH(key, keyHash)
+
+	// The entry may have been rejected for its weight, or by the eviction
+	// policy.
+	_, stored := s.dataMap.GetH(key, keyHash)
+	s.unlock()
+
+	if s.tooHeavy(weight) {
+		// Rejected without using the room.
+		s.unreserve(reserved)
+	}
+	if grown {
+		s.global.enforce()
+	}
+
+	return value, stored
+}
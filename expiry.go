@@ -0,0 +1,47 @@
+package ezcache
+
+import (
+	"math"
+	"time"
+)
+
+// Expiry computes when individual entries expire. Each method returns the
+// duration, starting now, after which the entry expires. A non-positive
+// duration means that the entry never expires. If an Expiry is set, it
+// replaces the cache's TTL.
+type Expiry[K Key[K], V any] interface {
+	// ExpireAfterCreate is called when an entry is inserted, either by Set or
+	// by a loader.
+	ExpireAfterCreate(key K, value V) time.Duration
+
+	// ExpireAfterUpdate is called when the value of an existing entry is
+	// replaced. currentDuration is the remaining time until the entry expires.
+	ExpireAfterUpdate(key K, value V, currentDuration time.Duration) time.Duration
+
+	// ExpireAfterRead is called when an entry is read. Returning
+	// currentDuration leaves the expiry unchanged. Reads do not block each
+	// other, so it may be called concurrently, even for the same entry.
+	ExpireAfterRead(key K, value V, currentDuration time.Duration) time.Duration
+}
+
+// neverExpires is the expireAt timestamp of entries that don't expire.
+const neverExpires = math.MaxInt64
+
+// expireAtAfter returns the expireAt timestamp of an entry that expires d
+// after now.
+func expireAtAfter(now time.Time, d time.Duration) int64 {
+	if d <= 0 {
+		return neverExpires
+	}
+
+	return now.Add(d).UnixMilli()
+}
+
+// remaining returns the time left until expireAt.
+func remaining(now time.Time, expireAt int64) time.Duration {
+	if expireAt == neverExpires {
+		return time.Duration(math.MaxInt64)
+	}
+
+	return time.Duration(expireAt-now.UnixMilli()) * time.Millisecond
+}
@@ -3,12 +3,11 @@ module github.com/birdayz/ezcache
 go 1.18
 
 require (
-	golang.org/x/exp v0.0.0-20211129234152-8a230f1f7d7a
+	golang.org/x/exp v0.0.0-20220722155223-a9213eeb770e
 	gotest.tools/v3 v3.0.3
 )
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/google/go-cmp v0.5.6 // indirect
+	github.com/google/go-cmp v0.5.8 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
 )
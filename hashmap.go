@@ -76,6 +76,30 @@ func (h *HashMap[K, V]) SetH(key K, value V, hash uint64) bool {
 	return false
 }
 
+// Len returns the number of entries in the map.
+func (h *HashMap[K, V]) Len() int {
+	return h.currentSize
+}
+
+// Range calls fn for each entry of the map, in no particular order, until fn
+// returns false. fn must not modify the map.
+func (h *HashMap[K, V]) Range(fn func(key K, value V) bool) {
+	h.rangeH(func(key K, value V, _ uint64) bool {
+		return fn(key, value)
+	})
+}
+
+// rangeH is like Range, but also passes the hash of each key to fn.
+func (h *HashMap[K, V]) rangeH(fn func(key K, value V, hash uint64) bool) {
+	for i := range h.buckets {
+		for _, e := range h.buckets[i].slots {
+			if !fn(e.key, e.value, e.hash) {
+				return
+			}
+		}
+	}
+}
+
 func (h *HashMap[K, V]) Set(key K, value V) bool {
 	hash := key.HashCode()
 	return h.SetH(key, value, hash)
@@ -110,6 +134,7 @@ func (h *HashMap[K, V]) DeleteH(key K, hash uint64) (prev V, deleted bool) {
 		if bucket.slots[i].key.Equals(key) {
 			oldVal := bucket.slots[i].value
 			bucket.slots = slices.Delete(bucket.slots, i, i+1)
+			h.currentSize--
 			return oldVal, true
 		}
 	}
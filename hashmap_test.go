@@ -54,3 +54,27 @@ func TestHashMapDelete(t *testing.T) {
 	res, ok = m.Get("keya")
 	assert.Equal(t, ok, false)
 }
+
+func TestHashMapRange(t *testing.T) {
+	m := NewHashMap[IntKey, int](16)
+	for i := 0; i < 100; i++ {
+		m.Set(IntKey(i), i)
+	}
+
+	seen := make(map[IntKey]int)
+	m.Range(func(key IntKey, value int) bool {
+		seen[key] = value
+		return true
+	})
+	assert.Equal(t, len(seen), 100)
+	for key, value := range seen {
+		assert.Equal(t, int(key), value)
+	}
+
+	visited := 0
+	m.Range(func(IntKey, int) bool {
+		visited++
+		return visited < 10
+	})
+	assert.Equal(t, visited, 10)
+}
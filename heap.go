@@ -1,7 +1,7 @@
 package ezcache
 
 import (
-	"constraints"
+	"golang.org/x/exp/constraints"
 )
 
 type HeapElement[T any] struct {
@@ -0,0 +1,118 @@
+package ezcache
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// zipfTrace returns n keys drawn from a Zipf distribution over keySpace keys.
+func zipfTrace(seed int64, n int, keySpace uint64) []IntKey {
+	r := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(r, 1.1, 1, keySpace-1)
+
+	trace := make([]IntKey, 0, n)
+	for i := 0; i < n; i++ {
+		trace = append(trace, IntKey(zipf.Uint64()))
+	}
+
+	return trace
+}
+
+// scanTrace is a Zipf trace, which is interrupted by a scan over scanLength
+// keys that are never used again every scanEvery requests.
+func scanTrace(seed int64, n int, keySpace uint64, scanEvery, scanLength int) []IntKey {
+	zipf := zipfTrace(seed, n, keySpace)
+
+	trace := make([]IntKey, 0, n+n/scanEvery*scanLength)
+	next := IntKey(keySpace)
+	for i, key := range zipf {
+		trace = append(trace, key)
+		if i%scanEvery == 0 {
+			for d := 0; d < scanLength; d++ {
+				trace = append(trace, next)
+				next++
+			}
+		}
+	}
+
+	return trace
+}
+
+// hitRate replays trace against cache, setting every key that misses, and
+// returns the share of hits.
+func hitRate(cache *Cache[IntKey, int], trace []IntKey) float64 {
+	hits := 0
+	for _, key := range trace {
+		if _, err := cache.Get(key); err == nil {
+			hits++
+			continue
+		}
+		cache.Set(key, int(key))
+	}
+
+	return float64(hits) / float64(len(trace))
+}
+
+func TestHitRateTinyLFU(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping hit rate simulation in short mode")
+	}
+
+	traces := []struct {
+		name  string
+		trace []IntKey
+	}{
+		{
+			name:  "Zipf",
+			trace: zipfTrace(1, 200000, 100000),
+		},
+		{
+			name:  "Scan",
+			trace: scanTrace(1, 200000, 100000, 5000, 5000),
+		},
+	}
+
+	for _, tt := range traces {
+		t.Run(tt.name, func(t *testing.T) {
+			lru := hitRate(NewBuilder[IntKey, int]().Capacity(1000).NumShards(1).Build(), tt.trace)
+			lfu := hitRate(NewBuilder[IntKey, int]().Capacity(1000).NumShards(1).TinyLFU().Build(), tt.trace)
+
+			t.Logf("LRU: %.2f%%, W-TinyLFU: %.2f%%", lru*100, lfu*100)
+			if lfu < lru {
+				t.Errorf("expected W-TinyLFU to have a hit rate at least as high as LRU")
+			}
+		})
+	}
+}
+
+func TestHitRatePolicies(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping hit rate simulation in short mode")
+	}
+
+	trace := zipfTrace(1, 200000, 100000)
+	for _, p := range policies {
+		cache := NewBuilder[IntKey, int]().Capacity(1000).NumShards(1).EvictionPolicy(p.factory).Build()
+		t.Logf("%s: %.2f%%", p.name, hitRate(cache, trace)*100)
+	}
+}
+
+func TestHitRateGlobalCapacity(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping hit rate simulation in short mode")
+	}
+
+	// All keys are multiples of 8, so they only map to 8 of the 64 shards.
+	trace := zipfTrace(1, 200000, 100000)
+	for i := range trace {
+		trace[i] *= 8
+	}
+
+	split := hitRate(NewBuilder[IntKey, int]().Capacity(1000).NumShards(64).Build(), trace)
+	global := hitRate(NewBuilder[IntKey, int]().Capacity(1000).NumShards(64).GlobalCapacity().Build(), trace)
+
+	t.Logf("Per-shard capacity: %.2f%%, global capacity: %.2f%%", split*100, global*100)
+	if global < split {
+		t.Errorf("expected global capacity to have a hit rate at least as high as per-shard capacity")
+	}
+}
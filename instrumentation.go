@@ -0,0 +1,47 @@
+package ezcache
+
+import "context"
+
+// Instrumentation is notified of lookups and loads, e.g. to trace them. Its
+// methods are called concurrently, and must not call back into the cache.
+type Instrumentation interface {
+	// StartGet is called when GetCtx starts to look up a key. The returned
+	// context is used for the rest of the lookup, including a load it
+	// starts. end is called with the outcome once the lookup completed.
+	StartGet(ctx context.Context, info GetInfo) (_ context.Context, end func(GetResult))
+
+	// StartLoad is called before a loader, reloader or bulk loader runs. It
+	// runs with the returned context, and end is called with its error once
+	// it returned.
+	StartLoad(ctx context.Context, info LoadInfo) (_ context.Context, end func(err error))
+}
+
+// GetInfo describes a lookup.
+type GetInfo struct {
+	KeyHash uint64
+	// Index of the shard the key belongs to.
+	Shard int
+}
+
+// GetResult is the outcome of a lookup.
+type GetResult struct {
+	// Hit is true if the value was cached.
+	Hit bool
+	// Shared is true if the value was not cached, and the lookup waited
+	// for a load started by another caller instead of starting one.
+	Shared bool
+	// The error returned to the caller, if any.
+	Err error
+}
+
+// LoadInfo describes a load.
+type LoadInfo struct {
+	KeyHash uint64
+	// Index of the shard the key belongs to.
+	Shard int
+	// Refresh is true if an entry that is cached is reloaded.
+	Refresh bool
+	// Number of keys that are loaded. It is larger than 1 for bulk loads,
+	// for which KeyHash and Shard describe the first key.
+	Keys int
+}
@@ -222,3 +222,18 @@ func (l *List[T]) PushFrontList(other *List[T]) {
 		l.insertValue(e.Value, &l.root)
 	}
 }
+
+// moveToFront moves e to the front of to. e keeps its identity, so handles
+// pointing to it stay valid.
+func moveToFront[T any](e *Element[T], from, to *List[T]) {
+	from.Remove(e)
+	to.lazyInit()
+	to.insert(e, &to.root)
+}
+
+// moveToBack is like moveToFront, but moves e to the back of to.
+func moveToBack[T any](e *Element[T], from, to *List[T]) {
+	from.Remove(e)
+	to.lazyInit()
+	to.insert(e, to.root.prev)
+}
@@ -0,0 +1,22 @@
+module github.com/birdayz/ezcache/otel
+
+go 1.18
+
+require (
+	github.com/birdayz/ezcache v0.0.0-20261018070007-6a255e5ddc93
+	github.com/google/go-cmp v0.5.9
+	go.opentelemetry.io/otel v1.14.0
+	go.opentelemetry.io/otel/metric v0.37.0
+	go.opentelemetry.io/otel/sdk v1.14.0
+	go.opentelemetry.io/otel/sdk/metric v0.37.0
+	go.opentelemetry.io/otel/trace v1.14.0
+	gotest.tools/v3 v3.0.3
+)
+
+require (
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/exp v0.0.0-20220722155223-a9213eeb770e // indirect
+	golang.org/x/sys v0.5.0 // indirect
+)
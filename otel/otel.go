@@ -0,0 +1,212 @@
+// Package otel instruments an ezcache.Cache with OpenTelemetry: lookups and
+// loads are traced, and the statistics of the cache are exported as metrics.
+package otel
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/birdayz/ezcache"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/birdayz/ezcache/otel"
+
+// Attributes of spans and metrics.
+const (
+	CacheKey   = attribute.Key("ezcache.cache")
+	KeyHashKey = attribute.Key("ezcache.key_hash")
+	ShardKey   = attribute.Key("ezcache.shard")
+	HitKey     = attribute.Key("ezcache.hit")
+	SharedKey  = attribute.Key("ezcache.shared")
+	RefreshKey = attribute.Key("ezcache.refresh")
+	KeysKey    = attribute.Key("ezcache.keys")
+	ResultKey  = attribute.Key("ezcache.result")
+	CauseKey   = attribute.Key("ezcache.cause")
+)
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	meterProvider  metric.MeterProvider
+}
+
+// Option configures Instrumentation and RegisterMetrics.
+type Option func(*config)
+
+// WithTracerProvider sets the provider of the tracer that creates spans.
+// Defaults to the global one.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = provider
+	}
+}
+
+// WithMeterProvider sets the provider of the meter that records metrics.
+// Defaults to the global one.
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(c *config) {
+		c.meterProvider = provider
+	}
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		tracerProvider: otel.GetTracerProvider(),
+		meterProvider:  global.MeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Instrumentation is an ezcache.Instrumentation that creates an ezcache.Get
+// span for every lookup with GetCtx, and an ezcache.Load span for every run
+// of a loader, which is a child of the lookup that started it. It also
+// records the duration of loads in the ezcache.load.duration histogram.
+type Instrumentation struct {
+	tracer       trace.Tracer
+	loadDuration instrument.Float64Histogram
+	cache        attribute.KeyValue
+}
+
+var _ ezcache.Instrumentation = (*Instrumentation)(nil)
+
+// NewInstrumentation returns an Instrumentation for the cache with the given
+// name.
+func NewInstrumentation(name string, opts ...Option) (*Instrumentation, error) {
+	c := newConfig(opts)
+
+	loadDuration, err := c.meterProvider.Meter(instrumentationName).Float64Histogram("ezcache.load.duration",
+		instrument.WithDescription("Time loads and refreshes took."),
+		instrument.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Instrumentation{
+		tracer:       c.tracerProvider.Tracer(instrumentationName),
+		loadDuration: loadDuration,
+		cache:        CacheKey.String(name),
+	}, nil
+}
+
+// StartGet implements ezcache.Instrumentation.
+func (i *Instrumentation) StartGet(ctx context.Context, info ezcache.GetInfo) (context.Context, func(ezcache.GetResult)) {
+	ctx, span := i.tracer.Start(ctx, "ezcache.Get", trace.WithAttributes(
+		i.cache,
+		KeyHashKey.String(strconv.FormatUint(info.KeyHash, 10)),
+		ShardKey.Int(info.Shard),
+	))
+
+	return ctx, func(result ezcache.GetResult) {
+		span.SetAttributes(HitKey.Bool(result.Hit), SharedKey.Bool(result.Shared))
+		// A key that is not found is a miss, not a failure.
+		if result.Err != nil && !errors.Is(result.Err, ezcache.ErrNotFound) {
+			span.RecordError(result.Err)
+			span.SetStatus(codes.Error, result.Err.Error())
+		}
+		span.End()
+	}
+}
+
+// StartLoad implements ezcache.Instrumentation.
+func (i *Instrumentation) StartLoad(ctx context.Context, info ezcache.LoadInfo) (context.Context, func(error)) {
+	ctx, span := i.tracer.Start(ctx, "ezcache.Load", trace.WithAttributes(
+		i.cache,
+		KeyHashKey.String(strconv.FormatUint(info.KeyHash, 10)),
+		ShardKey.Int(info.Shard),
+		RefreshKey.Bool(info.Refresh),
+		KeysKey.Int(info.Keys),
+	))
+
+	start := time.Now()
+	return ctx, func(err error) {
+		result := "success"
+		if err != nil {
+			result = "failure"
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+
+		// The span has ended, but ctx still carries it, so the
+		// measurement can be correlated with it.
+		i.loadDuration.Record(ctx, time.Since(start).Seconds(), i.cache, ResultKey.String(result))
+	}
+}
+
+// cache is the part of an ezcache.Cache that RegisterMetrics reads. It hides
+// the type parameters of the cache.
+type cache interface {
+	Stats() ezcache.Stats
+	Len() int
+	Weight() uint64
+}
+
+// RegisterMetrics exports the statistics of cache, with the given name, as
+// asynchronous instruments: the ezcache.hits, ezcache.misses, ezcache.loads
+// and ezcache.evictions counters, and the ezcache.entries and ezcache.weight
+// gauges. Hits, misses, loads and evictions are only counted if the cache was
+// built with RecordStats.
+//
+// The returned registration stops the export once it is unregistered.
+func RegisterMetrics[K ezcache.Key[K], V any](name string, c *ezcache.Cache[K, V], opts ...Option) (metric.Registration, error) {
+	return registerMetrics(name, c, newConfig(opts).meterProvider.Meter(instrumentationName))
+}
+
+func registerMetrics(name string, c cache, meter metric.Meter) (metric.Registration, error) {
+	hits, err := meter.Int64ObservableCounter("ezcache.hits",
+		instrument.WithDescription("Number of lookups that found a value."))
+	if err != nil {
+		return nil, err
+	}
+	misses, err := meter.Int64ObservableCounter("ezcache.misses",
+		instrument.WithDescription("Number of lookups that did not find a value."))
+	if err != nil {
+		return nil, err
+	}
+	loads, err := meter.Int64ObservableCounter("ezcache.loads",
+		instrument.WithDescription("Number of loads and refreshes, by result."))
+	if err != nil {
+		return nil, err
+	}
+	evictions, err := meter.Int64ObservableCounter("ezcache.evictions",
+		instrument.WithDescription("Number of entries that were evicted, by cause."))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := meter.Int64ObservableGauge("ezcache.entries",
+		instrument.WithDescription("Number of entries in the cache."))
+	if err != nil {
+		return nil, err
+	}
+	weight, err := meter.Int64ObservableGauge("ezcache.weight",
+		instrument.WithDescription("Total weight of the entries in the cache."))
+	if err != nil {
+		return nil, err
+	}
+
+	cacheName := CacheKey.String(name)
+	return meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		stats := c.Stats()
+		o.ObserveInt64(hits, int64(stats.Hits), cacheName)
+		o.ObserveInt64(misses, int64(stats.Misses), cacheName)
+		o.ObserveInt64(loads, int64(stats.LoadSuccesses), cacheName, ResultKey.String("success"))
+		o.ObserveInt64(loads, int64(stats.LoadFailures), cacheName, ResultKey.String("failure"))
+		o.ObserveInt64(evictions, int64(stats.Evictions), cacheName, CauseKey.String(ezcache.RemovalEvicted.String()))
+		o.ObserveInt64(evictions, int64(stats.Expirations), cacheName, CauseKey.String(ezcache.RemovalExpired.String()))
+		o.ObserveInt64(entries, int64(c.Len()), cacheName)
+		o.ObserveInt64(weight, int64(c.Weight()), cacheName)
+		return nil
+	}, hits, misses, loads, evictions, entries, weight)
+}
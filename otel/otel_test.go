@@ -0,0 +1,168 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/birdayz/ezcache"
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gotest.tools/v3/assert"
+)
+
+func attributes(kvs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+
+	return m
+}
+
+func TestInstrumentation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	instrumentation, err := NewInstrumentation("test", WithTracerProvider(tracerProvider), WithMeterProvider(meterProvider))
+	assert.NilError(t, err)
+
+	cache := ezcache.NewBuilder[ezcache.IntKey, int]().Loader(func(key ezcache.IntKey) (int, error) {
+		if key < 0 {
+			return 0, errors.New("negative key")
+		}
+		return int(key), nil
+	}).NumShards(4).Instrumentation(instrumentation).Build()
+
+	_, err = cache.GetCtx(context.Background(), 5)
+	assert.NilError(t, err)
+	_, err = cache.GetCtx(context.Background(), 5)
+	assert.NilError(t, err)
+	_, err = cache.GetCtx(context.Background(), -1)
+	assert.Assert(t, err != nil)
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, len(spans), 5)
+
+	// The load ends before the lookup that started it.
+	load, get := spans[0], spans[1]
+	assert.Equal(t, load.Name, "ezcache.Load")
+	assert.Equal(t, get.Name, "ezcache.Get")
+	assert.Equal(t, load.Parent.SpanID(), get.SpanContext.SpanID())
+	assert.DeepEqual(t, attributes(load.Attributes), map[attribute.Key]attribute.Value{
+		CacheKey:   attribute.StringValue("test"),
+		KeyHashKey: attribute.StringValue("5"),
+		ShardKey:   attribute.IntValue(1),
+		RefreshKey: attribute.BoolValue(false),
+		KeysKey:    attribute.IntValue(1),
+	}, cmp.Comparer(func(a, b attribute.Value) bool { return a == b }))
+	getAttributes := attributes(get.Attributes)
+	assert.Equal(t, getAttributes[HitKey].AsBool(), false)
+	assert.Equal(t, getAttributes[SharedKey].AsBool(), false)
+	assert.Equal(t, getAttributes[ShardKey].AsInt64(), int64(1))
+
+	hit := spans[2]
+	assert.Equal(t, hit.Name, "ezcache.Get")
+	assert.Equal(t, attributes(hit.Attributes)[HitKey].AsBool(), true)
+
+	failedLoad, failedGet := spans[3], spans[4]
+	assert.Equal(t, failedLoad.Status.Code, codes.Error)
+	assert.Equal(t, failedGet.Status.Code, codes.Error)
+	assert.Equal(t, len(failedLoad.Events), 1)
+
+	var rm metricdata.ResourceMetrics
+	assert.NilError(t, reader.Collect(context.Background(), &rm))
+	histogram := findMetric(t, rm, "ezcache.load.duration").Data.(metricdata.Histogram)
+	var count uint64
+	for _, point := range histogram.DataPoints {
+		count += point.Count
+	}
+	assert.Equal(t, count, uint64(2))
+}
+
+func TestInstrumentationNotFound(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	instrumentation, err := NewInstrumentation("test",
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))))
+	assert.NilError(t, err)
+
+	cache := ezcache.NewBuilder[ezcache.IntKey, int]().Instrumentation(instrumentation).Build()
+	_, err = cache.GetCtx(context.Background(), 1)
+	assert.Equal(t, err, ezcache.ErrNotFound)
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, len(spans), 1)
+	assert.Equal(t, spans[0].Status.Code, codes.Unset)
+	assert.Equal(t, attributes(spans[0].Attributes)[HitKey].AsBool(), false)
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	cache := ezcache.NewBuilder[ezcache.IntKey, int]().Loader(func(key ezcache.IntKey) (int, error) {
+		return int(key), nil
+	}).Capacity(1).NumShards(1).RecordStats().Build()
+
+	registration, err := RegisterMetrics("test", cache, WithMeterProvider(meterProvider))
+	assert.NilError(t, err)
+
+	// The shard holds two entries, so 1 is evicted.
+	for _, key := range []ezcache.IntKey{1, 1, 2, 3} {
+		_, err := cache.Get(key)
+		assert.NilError(t, err)
+	}
+
+	var rm metricdata.ResourceMetrics
+	assert.NilError(t, reader.Collect(context.Background(), &rm))
+
+	sum := func(name string, attrs ...attribute.KeyValue) int64 {
+		set := attribute.NewSet(append(attrs, CacheKey.String("test"))...)
+		var points []metricdata.DataPoint[int64]
+		switch data := findMetric(t, rm, name).Data.(type) {
+		case metricdata.Sum[int64]:
+			points = data.DataPoints
+		case metricdata.Gauge[int64]:
+			points = data.DataPoints
+		}
+		for _, point := range points {
+			if point.Attributes.Equals(&set) {
+				return point.Value
+			}
+		}
+		t.Fatalf("no data point of %s with attributes %v", name, attrs)
+		return 0
+	}
+
+	assert.Equal(t, sum("ezcache.hits"), int64(1))
+	assert.Equal(t, sum("ezcache.misses"), int64(3))
+	assert.Equal(t, sum("ezcache.loads", ResultKey.String("success")), int64(3))
+	assert.Equal(t, sum("ezcache.loads", ResultKey.String("failure")), int64(0))
+	assert.Equal(t, sum("ezcache.evictions", CauseKey.String("evicted")), int64(1))
+	assert.Equal(t, sum("ezcache.evictions", CauseKey.String("expired")), int64(0))
+	assert.Equal(t, sum("ezcache.entries"), int64(2))
+	assert.Equal(t, sum("ezcache.weight"), int64(2))
+
+	assert.NilError(t, registration.Unregister())
+}
+
+func findMetric(t *testing.T, rm metricdata.ResourceMetrics, name string) metricdata.Metrics {
+	t.Helper()
+
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name == name {
+				return m
+			}
+		}
+	}
+	t.Fatalf("metric %s was not collected", name)
+	return metricdata.Metrics{}
+}
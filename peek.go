@@ -0,0 +1,59 @@
+package ezcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EntryInfo describes an entry of the cache.
+type EntryInfo[V any] struct {
+	Value V
+	// Version of the entry, as returned by GetVersioned.
+	Version uint64
+	Weight  uint64
+
+	// When the entry was inserted, and last written. Replacing the value
+	// of an entry updates WrittenAt, but not InsertedAt.
+	InsertedAt time.Time
+	WrittenAt  time.Time
+	// When the entry was last read. Zero if it was never read.
+	AccessedAt time.Time
+	// When the entry expires. Zero if it never expires.
+	ExpiresAt time.Time
+
+	// Number of times the entry was read.
+	Hits uint64
+}
+
+// peek returns the entry for key without counting it as an access. Entries
+// that expired are not returned. The caller must hold the lock or the read
+// lock.
+func (s *shard[K, V]) peek(key K, keyHash uint64) (*cacheEntry[K, V], bool) {
+	entry, ok := s.dataMap.GetH(key, keyHash)
+	if !ok || (s.ttls != nil && s.expired(entry, s.clock.Now().UnixMilli())) {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// entryInfo returns the metadata of entry. The caller must hold the lock or
+// the read lock.
+func (s *shard[K, V]) entryInfo(entry *cacheEntry[K, V]) EntryInfo[V] {
+	info := EntryInfo[V]{
+		Value:      entry.value,
+		Version:    entry.version,
+		Weight:     entry.weight,
+		InsertedAt: time.UnixMilli(entry.insertedAt),
+		WrittenAt:  time.UnixMilli(entry.writtenAt),
+		Hits:       atomic.LoadUint64(&entry.hits),
+	}
+	if accessedAt := atomic.LoadInt64(&entry.accessedAt); accessedAt != 0 {
+		info.AccessedAt = time.UnixMilli(accessedAt)
+	}
+	if expireAt := atomic.LoadInt64(&entry.expireAt); expireAt != neverExpires {
+		info.ExpiresAt = time.UnixMilli(expireAt)
+	}
+
+	return info
+}
@@ -0,0 +1,272 @@
+package ezcache
+
+// PolicyEntry is the handle an EvictionPolicy gets for each entry of a shard.
+// The same handle is passed to all hooks of an entry, so policies can use it
+// as a map key to associate their own bookkeeping with it.
+type PolicyEntry[K any] struct {
+	Key  K
+	Hash uint64
+
+	// Bookkeeping of the built-in policies.
+	element     *Element[*PolicyEntry[K]]
+	heapElement *HeapElement[*PolicyEntry[K]]
+	segment     int
+	freq        int
+	tick        uint64
+}
+
+// EvictionPolicy decides which entry to evict once a shard is full. Each
+// shard has its own policy instance. All hooks are called while the shard is
+// locked, so policies don't need to be safe for concurrent use.
+type EvictionPolicy[K any] interface {
+	// OnInsert is called after a new entry was added.
+	OnInsert(e *PolicyEntry[K])
+	// OnAccess is called when an entry is read, or its value is replaced.
+	OnAccess(e *PolicyEntry[K])
+	// OnRemove is called after an entry was removed, for any reason,
+	// including eviction.
+	OnRemove(e *PolicyEntry[K])
+	// Victim returns the entry that should be evicted next. It is only called
+	// if the policy tracks at least one entry, and the returned entry is
+	// removed right away. The entry that was inserted last may be returned
+	// to reject it.
+	Victim() *PolicyEntry[K]
+}
+
+// victimPeeker is implemented by eviction policies that can tell their
+// victim without changing their state. GlobalCapacity uses it to compare the
+// victims of several shards. All built-in policies implement it.
+type victimPeeker[K any] interface {
+	// PeekVictim returns the entry that Victim would return. It is only
+	// called if the policy tracks at least one entry.
+	PeekVictim() *PolicyEntry[K]
+}
+
+// PolicyFactory creates the eviction policy of a shard that can hold up to
+// capacity entries.
+type PolicyFactory[K any] func(capacity int) EvictionPolicy[K]
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy[K any] struct {
+	list *List[*PolicyEntry[K]]
+}
+
+// NewLRUPolicy returns a policy that evicts the least recently used entry.
+// This is the default.
+func NewLRUPolicy[K any](capacity int) EvictionPolicy[K] {
+	return &lruPolicy[K]{
+		list: NewList[*PolicyEntry[K]](),
+	}
+}
+
+func (p *lruPolicy[K]) OnInsert(e *PolicyEntry[K]) { e.element = p.list.PushFront(e) }
+func (p *lruPolicy[K]) OnAccess(e *PolicyEntry[K]) { p.list.MoveToFront(e.element) }
+func (p *lruPolicy[K]) OnRemove(e *PolicyEntry[K]) { p.list.Remove(e.element) }
+func (p *lruPolicy[K]) Victim() *PolicyEntry[K]    { return p.list.Back().Value }
+
+func (p *lruPolicy[K]) PeekVictim() *PolicyEntry[K] { return p.Victim() }
+
+// fifoPolicy evicts the entry that was inserted first.
+type fifoPolicy[K any] struct {
+	list *List[*PolicyEntry[K]]
+}
+
+// NewFIFOPolicy returns a policy that evicts the entry that was inserted
+// first, regardless of how it is used.
+func NewFIFOPolicy[K any](capacity int) EvictionPolicy[K] {
+	return &fifoPolicy[K]{
+		list: NewList[*PolicyEntry[K]](),
+	}
+}
+
+func (p *fifoPolicy[K]) OnInsert(e *PolicyEntry[K]) { e.element = p.list.PushFront(e) }
+func (p *fifoPolicy[K]) OnAccess(e *PolicyEntry[K]) {}
+func (p *fifoPolicy[K]) OnRemove(e *PolicyEntry[K]) { p.list.Remove(e.element) }
+func (p *fifoPolicy[K]) Victim() *PolicyEntry[K]    { return p.list.Back().Value }
+
+func (p *fifoPolicy[K]) PeekVictim() *PolicyEntry[K] { return p.Victim() }
+
+// clockPolicy approximates LRU with a reference bit per entry, which is
+// cheaper to maintain on reads than moving entries around.
+type clockPolicy[K any] struct {
+	// Entries in insertion order. The front is where the clock hand points
+	// to.
+	ring *List[*PolicyEntry[K]]
+}
+
+// NewClockPolicy returns a CLOCK policy, which approximates LRU. Reads only
+// set a reference bit. When looking for a victim, the clock hand sweeps over
+// the entries, giving every entry whose bit is set a second chance.
+func NewClockPolicy[K any](capacity int) EvictionPolicy[K] {
+	return &clockPolicy[K]{
+		ring: NewList[*PolicyEntry[K]](),
+	}
+}
+
+func (p *clockPolicy[K]) OnInsert(e *PolicyEntry[K]) {
+	e.freq = 0
+	e.element = p.ring.PushBack(e)
+}
+
+func (p *clockPolicy[K]) OnAccess(e *PolicyEntry[K]) { e.freq = 1 }
+func (p *clockPolicy[K]) OnRemove(e *PolicyEntry[K]) { p.ring.Remove(e.element) }
+
+func (p *clockPolicy[K]) Victim() *PolicyEntry[K] {
+	for {
+		hand := p.ring.Front()
+		if hand.Value.freq == 0 {
+			return hand.Value
+		}
+
+		hand.Value.freq = 0
+		p.ring.MoveToBack(hand)
+	}
+}
+
+func (p *clockPolicy[K]) PeekVictim() *PolicyEntry[K] {
+	for hand := p.ring.Front(); hand != nil; hand = hand.Next() {
+		if hand.Value.freq == 0 {
+			return hand.Value
+		}
+	}
+
+	// All reference bits are set. Victim clears them in one sweep, and ends
+	// up where it started.
+	return p.ring.Front().Value
+}
+
+// Segments of the segmented LRU policies.
+const (
+	segmentWindow = iota
+	segmentProbation
+	segmentProtected
+)
+
+// slruPolicy is a segmented LRU.
+type slruPolicy[K any] struct {
+	probation *List[*PolicyEntry[K]]
+	protected *List[*PolicyEntry[K]]
+
+	maxProtected int
+}
+
+// NewSLRUPolicy returns a segmented LRU policy. New entries enter a
+// probation segment, and are promoted to a protected segment, which takes up
+// 80% of the capacity, once they are read again. Victims are taken from the
+// probation segment first, so entries that are used only once can't push out
+// entries that are used repeatedly.
+func NewSLRUPolicy[K any](capacity int) EvictionPolicy[K] {
+	return &slruPolicy[K]{
+		probation:    NewList[*PolicyEntry[K]](),
+		protected:    NewList[*PolicyEntry[K]](),
+		maxProtected: capacity * 8 / 10,
+	}
+}
+
+func (p *slruPolicy[K]) OnInsert(e *PolicyEntry[K]) {
+	e.segment = segmentProbation
+	e.element = p.probation.PushFront(e)
+}
+
+func (p *slruPolicy[K]) OnAccess(e *PolicyEntry[K]) {
+	if e.segment == segmentProtected {
+		p.protected.MoveToFront(e.element)
+		return
+	}
+
+	e.segment = segmentProtected
+	moveToFront(e.element, p.probation, p.protected)
+
+	// Make room in the protected segment by demoting its least recently used
+	// entry.
+	if p.protected.Len() > p.maxProtected {
+		demoted := p.protected.Back()
+		demoted.Value.segment = segmentProbation
+		moveToFront(demoted, p.protected, p.probation)
+	}
+}
+
+func (p *slruPolicy[K]) OnRemove(e *PolicyEntry[K]) {
+	if e.segment == segmentProtected {
+		p.protected.Remove(e.element)
+		return
+	}
+	p.probation.Remove(e.element)
+}
+
+func (p *slruPolicy[K]) Victim() *PolicyEntry[K] {
+	if p.probation.Len() > 0 {
+		return p.probation.Back().Value
+	}
+	return p.protected.Back().Value
+}
+
+func (p *slruPolicy[K]) PeekVictim() *PolicyEntry[K] { return p.Victim() }
+
+// lfuPolicy evicts the least frequently used entry.
+type lfuPolicy[K any] struct {
+	heap *Heap[*PolicyEntry[K]]
+
+	// Logical clock, to break ties between entries that were used equally
+	// often in favor of the most recently used one.
+	tick uint64
+
+	// The entry that was inserted last. It has the lowest possible frequency,
+	// but must get a chance to be used before it is evicted.
+	inserted *PolicyEntry[K]
+}
+
+// NewLFUPolicy returns a policy that evicts the least frequently used entry.
+// Among entries that were used equally often, the least recently used one is
+// evicted.
+func NewLFUPolicy[K any](capacity int) EvictionPolicy[K] {
+	return &lfuPolicy[K]{
+		heap: NewHeap(func(e1, e2 *PolicyEntry[K]) int {
+			switch {
+			case e1.freq != e2.freq:
+				return AscendingComparator(e1.freq, e2.freq)
+			default:
+				return AscendingComparator(e1.tick, e2.tick)
+			}
+		}, capacity),
+	}
+}
+
+func (p *lfuPolicy[K]) OnInsert(e *PolicyEntry[K]) {
+	p.tick++
+	e.freq = 1
+	e.tick = p.tick
+	e.heapElement = p.heap.Push(e)
+	p.inserted = e
+}
+
+func (p *lfuPolicy[K]) OnAccess(e *PolicyEntry[K]) {
+	p.tick++
+	e.freq++
+	e.tick = p.tick
+	p.heap.Fix(e.heapElement)
+}
+
+func (p *lfuPolicy[K]) OnRemove(e *PolicyEntry[K]) {
+	if e == p.inserted {
+		p.inserted = nil
+	}
+	p.heap.Remove(e.heapElement)
+}
+
+func (p *lfuPolicy[K]) Victim() *PolicyEntry[K] {
+	victim := p.heap.Peek().Item
+	if victim != p.inserted || len(p.heap.data) == 1 {
+		return victim
+	}
+
+	// Skip the entry that was inserted last. The next smallest entry is one
+	// of the children of the root.
+	next := p.heap.data[1].Item
+	if len(p.heap.data) > 2 && p.heap.comparator(p.heap.data[2].Item, next) < 0 {
+		next = p.heap.data[2].Item
+	}
+	return next
+}
+
+func (p *lfuPolicy[K]) PeekVictim() *PolicyEntry[K] { return p.Victim() }
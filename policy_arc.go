@@ -0,0 +1,179 @@
+package ezcache
+
+// arcPolicy implements the Adaptive Replacement Cache.
+//
+// See "ARC: A Self-Tuning, Low Overhead Replacement Cache" by Nimrod Megiddo
+// and Dharmendra S. Modha.
+type arcPolicy[K any] struct {
+	capacity int
+
+	// Entries that were seen once (t1) and at least twice (t2) recently.
+	t1 *List[*PolicyEntry[K]]
+	t2 *List[*PolicyEntry[K]]
+
+	// Ghosts: hashes of the entries recently evicted from t1 and t2.
+	b1 ghostList
+	b2 ghostList
+
+	// Target size of t1.
+	p int
+
+	// The entry returned by Victim, which is about to be evicted.
+	evicting *PolicyEntry[K]
+
+	// The entry that was inserted last. Classic ARC makes room before it
+	// inserts, so this entry is not considered when choosing a victim.
+	inserted *PolicyEntry[K]
+}
+
+// NewARCPolicy returns an Adaptive Replacement Cache policy. It balances
+// between recency and frequency, by splitting the capacity between entries
+// that were used once and entries that were used at least twice. The split
+// adapts to the workload, based on which of the two sides recently evicted
+// entries are requested again from.
+func NewARCPolicy[K any](capacity int) EvictionPolicy[K] {
+	return &arcPolicy[K]{
+		capacity: capacity,
+		t1:       NewList[*PolicyEntry[K]](),
+		t2:       NewList[*PolicyEntry[K]](),
+		b1:       newGhostList(),
+		b2:       newGhostList(),
+	}
+}
+
+func (p *arcPolicy[K]) OnInsert(e *PolicyEntry[K]) {
+	p.inserted = e
+
+	switch {
+	case p.b1.remove(e.Hash):
+		// Recency would have helped: grow t1.
+		delta := 1
+		if p.b2.len() > p.b1.len()+1 {
+			delta = p.b2.len() / (p.b1.len() + 1)
+		}
+		p.p += delta
+		if p.p > p.capacity {
+			p.p = p.capacity
+		}
+	case p.b2.remove(e.Hash):
+		// Frequency would have helped: shrink t1.
+		delta := 1
+		if p.b1.len() > p.b2.len()+1 {
+			delta = p.b1.len() / (p.b2.len() + 1)
+		}
+		p.p -= delta
+		if p.p < 0 {
+			p.p = 0
+		}
+	default:
+		e.segment = segmentProbation
+		e.element = p.t1.PushFront(e)
+		return
+	}
+
+	e.segment = segmentProtected
+	e.element = p.t2.PushFront(e)
+}
+
+func (p *arcPolicy[K]) OnAccess(e *PolicyEntry[K]) {
+	if e.segment == segmentProtected {
+		p.t2.MoveToFront(e.element)
+		return
+	}
+
+	e.segment = segmentProtected
+	moveToFront(e.element, p.t1, p.t2)
+}
+
+func (p *arcPolicy[K]) OnRemove(e *PolicyEntry[K]) {
+	evicted := e == p.evicting
+	p.evicting = nil
+	if e == p.inserted {
+		p.inserted = nil
+	}
+
+	if e.segment == segmentProtected {
+		p.t2.Remove(e.element)
+		if evicted {
+			p.b2.add(e.Hash)
+		}
+	} else {
+		p.t1.Remove(e.element)
+		if evicted {
+			p.b1.add(e.Hash)
+		}
+	}
+
+	// Keep the ghosts bounded.
+	for p.t1.Len()+p.b1.len() > p.capacity && p.b1.len() > 0 {
+		p.b1.removeOldest()
+	}
+	for p.t1.Len()+p.t2.Len()+p.b1.len()+p.b2.len() > 2*p.capacity && p.b2.len() > 0 {
+		p.b2.removeOldest()
+	}
+}
+
+func (p *arcPolicy[K]) Victim() *PolicyEntry[K] {
+	p.evicting = p.PeekVictim()
+	return p.evicting
+}
+
+func (p *arcPolicy[K]) PeekVictim() *PolicyEntry[K] {
+	t1, t2 := p.t1.Len(), p.t2.Len()
+	if p.inserted != nil {
+		if p.inserted.segment == segmentProtected {
+			t2--
+		} else {
+			t1--
+		}
+	}
+
+	switch {
+	case t1 > 0 && (t1 > p.p || t2 == 0):
+		return p.t1.Back().Value
+	case t2 > 0:
+		return p.t2.Back().Value
+	default:
+		// The entry that was inserted last is the only one.
+		return p.inserted
+	}
+}
+
+// ghostList remembers the hashes of evicted entries, oldest first out.
+type ghostList struct {
+	order    *List[uint64]
+	elements map[uint64]*Element[uint64]
+}
+
+func newGhostList() ghostList {
+	return ghostList{
+		order:    NewList[uint64](),
+		elements: make(map[uint64]*Element[uint64]),
+	}
+}
+
+func (g ghostList) len() int { return g.order.Len() }
+
+func (g ghostList) add(hash uint64) {
+	if e, ok := g.elements[hash]; ok {
+		g.order.MoveToFront(e)
+		return
+	}
+	g.elements[hash] = g.order.PushFront(hash)
+}
+
+// remove forgets hash, and returns true if it was known.
+func (g ghostList) remove(hash uint64) bool {
+	e, ok := g.elements[hash]
+	if !ok {
+		return false
+	}
+
+	g.order.Remove(e)
+	delete(g.elements, hash)
+	return true
+}
+
+func (g ghostList) removeOldest() {
+	g.remove(g.order.Back().Value)
+}
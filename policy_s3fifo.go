@@ -0,0 +1,145 @@
+package ezcache
+
+// s3fifoPolicy implements S3-FIFO.
+//
+// See "FIFO queues are all you need for cache eviction" by Juncheng Yang,
+// Yazhuo Zhang, Ziyue Qiu, Yao Yue and Rashmi Vinayak.
+type s3fifoPolicy[K any] struct {
+	// New entries enter small. Entries that were accessed while in small,
+	// or that are found in ghost, enter main.
+	small *List[*PolicyEntry[K]]
+	main  *List[*PolicyEntry[K]]
+	ghost ghostList
+
+	maxSmall int
+	maxGhost int
+
+	// The entry returned by Victim, which is about to be evicted.
+	evicting *PolicyEntry[K]
+}
+
+// Access counts are capped at s3fifoMaxFreq.
+const s3fifoMaxFreq = 3
+
+// NewS3FIFOPolicy returns an S3-FIFO policy. It uses a small FIFO queue
+// taking 10% of the capacity to filter out entries that are used only once
+// quickly, a main FIFO queue that gives entries that were used again another
+// round, and a ghost queue remembering entries recently evicted from the
+// small queue. Reads only increment a counter, and never move entries.
+func NewS3FIFOPolicy[K any](capacity int) EvictionPolicy[K] {
+	maxSmall := capacity / 10
+	if maxSmall < 1 {
+		maxSmall = 1
+	}
+	maxGhost := capacity - maxSmall
+	if maxGhost < 0 {
+		maxGhost = 0
+	}
+
+	return &s3fifoPolicy[K]{
+		small:    NewList[*PolicyEntry[K]](),
+		main:     NewList[*PolicyEntry[K]](),
+		ghost:    newGhostList(),
+		maxSmall: maxSmall,
+		maxGhost: maxGhost,
+	}
+}
+
+func (p *s3fifoPolicy[K]) OnInsert(e *PolicyEntry[K]) {
+	e.freq = 0
+	if p.ghost.remove(e.Hash) {
+		e.segment = segmentProtected
+		e.element = p.main.PushFront(e)
+		return
+	}
+
+	e.segment = segmentProbation
+	e.element = p.small.PushFront(e)
+}
+
+func (p *s3fifoPolicy[K]) OnAccess(e *PolicyEntry[K]) {
+	if e.freq < s3fifoMaxFreq {
+		e.freq++
+	}
+}
+
+func (p *s3fifoPolicy[K]) OnRemove(e *PolicyEntry[K]) {
+	evicted := e == p.evicting
+	p.evicting = nil
+
+	if e.segment == segmentProtected {
+		p.main.Remove(e.element)
+		return
+	}
+
+	p.small.Remove(e.element)
+	if evicted {
+		p.ghost.add(e.Hash)
+		for p.ghost.len() > p.maxGhost {
+			p.ghost.removeOldest()
+		}
+	}
+}
+
+func (p *s3fifoPolicy[K]) Victim() *PolicyEntry[K] {
+	for {
+		if p.small.Len() > 0 && (p.small.Len() > p.maxSmall || p.main.Len() == 0) {
+			// Entries that were used while in the small queue move on to
+			// main, all others are evicted.
+			e := p.small.Back().Value
+			if e.freq == 0 {
+				p.evicting = e
+				return e
+			}
+
+			e.freq = 0
+			e.segment = segmentProtected
+			moveToFront(e.element, p.small, p.main)
+			continue
+		}
+
+		// Entries in main that were used get another round.
+		e := p.main.Back().Value
+		if e.freq == 0 {
+			p.evicting = e
+			return e
+		}
+
+		e.freq--
+		p.main.MoveToFront(e.element)
+	}
+}
+
+// PeekVictim replays Victim without moving entries or touching their counts.
+func (p *s3fifoPolicy[K]) PeekVictim() *PolicyEntry[K] {
+	// Entries of the small queue that Victim would move to main. They end up
+	// behind all entries that are in main already, with a count of zero.
+	var promoted *PolicyEntry[K]
+	moved := 0
+	for e := p.small.Back(); e != nil && (p.small.Len()-moved > p.maxSmall || p.main.Len()+moved == 0); e = e.Prev() {
+		if e.Value.freq == 0 {
+			return e.Value
+		}
+		if promoted == nil {
+			promoted = e.Value
+		}
+		moved++
+	}
+
+	// Each round over main decrements all counts, so the first entry with the
+	// lowest count is evicted.
+	var victim *PolicyEntry[K]
+	for e := p.main.Back(); e != nil; e = e.Prev() {
+		if e.Value.freq == 0 {
+			return e.Value
+		}
+		if victim == nil || e.Value.freq < victim.freq {
+			victim = e.Value
+		}
+	}
+
+	if promoted != nil {
+		return promoted
+	}
+	return victim
+}
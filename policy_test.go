@@ -0,0 +1,221 @@
+package ezcache
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+var policies = []struct {
+	name    string
+	factory PolicyFactory[IntKey]
+}{
+	{"LRU", NewLRUPolicy[IntKey]},
+	{"LFU", NewLFUPolicy[IntKey]},
+	{"FIFO", NewFIFOPolicy[IntKey]},
+	{"CLOCK", NewClockPolicy[IntKey]},
+	{"SLRU", NewSLRUPolicy[IntKey]},
+	{"ARC", NewARCPolicy[IntKey]},
+	{"S3-FIFO", NewS3FIFOPolicy[IntKey]},
+	{"W-TinyLFU", NewTinyLFUPolicy[IntKey]},
+}
+
+func newPolicyShard(capacity int, factory PolicyFactory[IntKey]) *shard[IntKey, int] {
+	shard := newShard[IntKey, int](capacity, time.Hour)
+	shard.policy = factory(capacity)
+	return shard
+}
+
+func TestPoliciesRandomOperations(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			shard := newPolicyShard(50, p.factory)
+			r := rand.New(rand.NewSource(1))
+
+			for i := 0; i < 100000; i++ {
+				key := IntKey(r.Intn(200))
+				switch r.Intn(4) {
+				case 0, 1:
+					shard.get(key, key.HashCode())
+				case 2:
+					shard.set(key, key.HashCode(), int(key))
+				case 3:
+					shard.Delete(key)
+				}
+
+				assert.Assert(t, shard.dataMap.Len() <= 50)
+			}
+
+			// Every remaining entry can still be read
+			for i := 0; i < 200; i++ {
+				if res, ok := shard.get(IntKey(i), IntKey(i).HashCode()); ok {
+					assert.Equal(t, res, i)
+				}
+			}
+		})
+	}
+}
+
+// TestPoliciesPeekVictim checks that PeekVictim returns the entry Victim
+// returns, and that peeking does not change which entries are evicted.
+func TestPoliciesPeekVictim(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			// peeked is peeked at before every operation, plain never.
+			peeked, plain := p.factory(50), p.factory(50)
+			peekedEntries := map[IntKey]*PolicyEntry[IntKey]{}
+			plainEntries := map[IntKey]*PolicyEntry[IntKey]{}
+			r := rand.New(rand.NewSource(1))
+
+			for i := 0; i < 100000; i++ {
+				var victim *PolicyEntry[IntKey]
+				if len(peekedEntries) > 0 {
+					peeker := peeked.(victimPeeker[IntKey])
+					victim = peeker.PeekVictim()
+					assert.Equal(t, peeker.PeekVictim(), victim)
+				}
+
+				key := IntKey(r.Intn(200))
+				_, found := peekedEntries[key]
+				switch {
+				case len(peekedEntries) > 50 || (len(peekedEntries) > 0 && r.Intn(10) == 0):
+					assert.Equal(t, peeked.Victim(), victim)
+					assert.Equal(t, plain.Victim().Key, victim.Key)
+					peeked.OnRemove(victim)
+					plain.OnRemove(plainEntries[victim.Key])
+					delete(peekedEntries, victim.Key)
+					delete(plainEntries, victim.Key)
+				case found:
+					peeked.OnAccess(peekedEntries[key])
+					plain.OnAccess(plainEntries[key])
+				default:
+					peekedEntries[key] = &PolicyEntry[IntKey]{Key: key, Hash: key.HashCode()}
+					plainEntries[key] = &PolicyEntry[IntKey]{Key: key, Hash: key.HashCode()}
+					peeked.OnInsert(peekedEntries[key])
+					plain.OnInsert(plainEntries[key])
+				}
+			}
+		})
+	}
+}
+
+func TestLRUPolicy(t *testing.T) {
+	shard := newPolicyShard(3, NewLRUPolicy[IntKey])
+	for i := 0; i < 3; i++ {
+		shard.set(IntKey(i), IntKey(i).HashCode(), i)
+	}
+	shard.get(0, IntKey(0).HashCode())
+	shard.set(3, IntKey(3).HashCode(), 3)
+
+	_, ok := shard.get(1, IntKey(1).HashCode())
+	assert.Equal(t, ok, false)
+	_, ok = shard.get(0, IntKey(0).HashCode())
+	assert.Equal(t, ok, true)
+}
+
+func TestFIFOPolicy(t *testing.T) {
+	shard := newPolicyShard(3, NewFIFOPolicy[IntKey])
+	for i := 0; i < 3; i++ {
+		shard.set(IntKey(i), IntKey(i).HashCode(), i)
+	}
+	shard.get(0, IntKey(0).HashCode())
+	shard.set(3, IntKey(3).HashCode(), 3)
+
+	// Reads don't matter, the first inserted entry is evicted
+	_, ok := shard.get(0, IntKey(0).HashCode())
+	assert.Equal(t, ok, false)
+	_, ok = shard.get(1, IntKey(1).HashCode())
+	assert.Equal(t, ok, true)
+}
+
+func TestClockPolicy(t *testing.T) {
+	shard := newPolicyShard(3, NewClockPolicy[IntKey])
+	for i := 0; i < 3; i++ {
+		shard.set(IntKey(i), IntKey(i).HashCode(), i)
+	}
+	shard.get(0, IntKey(0).HashCode())
+	shard.set(3, IntKey(3).HashCode(), 3)
+
+	// 0 got a second chance
+	_, ok := shard.get(1, IntKey(1).HashCode())
+	assert.Equal(t, ok, false)
+	_, ok = shard.get(0, IntKey(0).HashCode())
+	assert.Equal(t, ok, true)
+}
+
+func TestLFUPolicy(t *testing.T) {
+	shard := newPolicyShard(3, NewLFUPolicy[IntKey])
+	for i := 0; i < 3; i++ {
+		shard.set(IntKey(i), IntKey(i).HashCode(), i)
+	}
+	for i := 0; i < 3; i++ {
+		shard.get(0, IntKey(0).HashCode())
+		shard.get(2, IntKey(2).HashCode())
+	}
+	shard.get(1, IntKey(1).HashCode())
+	shard.set(3, IntKey(3).HashCode(), 3)
+
+	// 1 was used least often, even though it was used most recently
+	_, ok := shard.get(1, IntKey(1).HashCode())
+	assert.Equal(t, ok, false)
+	for _, k := range []IntKey{0, 2, 3} {
+		_, ok = shard.get(k, k.HashCode())
+		assert.Equal(t, ok, true)
+	}
+}
+
+// TestScanResistantPolicies checks that a scan over keys that are used once
+// does not flush the keys that are used repeatedly.
+func TestScanResistantPolicies(t *testing.T) {
+	for _, p := range policies {
+		switch p.name {
+		case "LRU", "FIFO", "CLOCK", "LFU":
+			continue
+		}
+
+		t.Run(p.name, func(t *testing.T) {
+			shard := newPolicyShard(100, p.factory)
+
+			for round := 0; round < 5; round++ {
+				for i := 0; i < 50; i++ {
+					if _, ok := shard.get(IntKey(i), IntKey(i).HashCode()); !ok {
+						shard.set(IntKey(i), IntKey(i).HashCode(), i)
+					}
+				}
+			}
+
+			for i := 1000; i < 10000; i++ {
+				shard.set(IntKey(i), IntKey(i).HashCode(), i)
+			}
+
+			survived := 0
+			for i := 0; i < 50; i++ {
+				if _, ok := shard.get(IntKey(i), IntKey(i).HashCode()); ok {
+					survived++
+				}
+			}
+			assert.Assert(t, survived >= 45, survived)
+		})
+	}
+}
+
+func TestPoliciesMaxWeight(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			cache := NewBuilder[IntKey, int]().EvictionPolicy(p.factory).Weigher(func(key IntKey, value int) uint64 {
+				return uint64(value%10 + 1)
+			}).MaxWeight(100).Capacity(0).NumShards(1).Build()
+
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 10000; i++ {
+				key := IntKey(r.Intn(200))
+				if _, err := cache.Get(key); err != nil {
+					cache.Set(key, int(key))
+				}
+				assert.Assert(t, cache.Weight() <= 100)
+			}
+		})
+	}
+}
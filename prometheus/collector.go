@@ -0,0 +1,116 @@
+// Package prometheus exports the statistics of an ezcache.Cache as
+// Prometheus metrics.
+package prometheus
+
+import (
+	"strconv"
+
+	"github.com/birdayz/ezcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// source is the part of an ezcache.Cache the collector reads. It hides the
+// type parameters of the cache.
+type source interface {
+	Stats() ezcache.Stats
+	Len() int
+	Weight() uint64
+	ShardLens() []int
+}
+
+// Collector is a prometheus.Collector that exports the statistics of a cache.
+// All metrics are prefixed with ezcache_, and carry a cache label with the
+// name of the cache, so the collectors of several caches can be registered
+// side by side.
+//
+// Hits, misses, loads and evictions are only counted if the cache was built
+// with RecordStats. The size of the cache is always exported.
+type Collector struct {
+	cache source
+
+	hits          *prometheus.Desc
+	misses        *prometheus.Desc
+	loads         *prometheus.Desc
+	loadDuration  *prometheus.Desc
+	evictions     *prometheus.Desc
+	entries       *prometheus.Desc
+	weight        *prometheus.Desc
+	shardEntries  *prometheus.Desc
+	bucketSeconds []float64
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a collector for cache, which is exported with the
+// given name.
+func NewCollector[K ezcache.Key[K], V any](name string, cache *ezcache.Cache[K, V]) *Collector {
+	labels := prometheus.Labels{"cache": name}
+	desc := func(metric, help string, variableLabels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("ezcache_"+metric, help, variableLabels, labels)
+	}
+
+	bucketSeconds := make([]float64, len(ezcache.LoadTimeBuckets))
+	for i, bucket := range ezcache.LoadTimeBuckets {
+		bucketSeconds[i] = bucket.Seconds()
+	}
+
+	return &Collector{
+		cache:         cache,
+		hits:          desc("hits_total", "Number of lookups that found a value."),
+		misses:        desc("misses_total", "Number of lookups that did not find a value."),
+		loads:         desc("loads_total", "Number of loads and refreshes, by result.", "result"),
+		loadDuration:  desc("load_duration_seconds", "Time loads and refreshes took."),
+		evictions:     desc("evictions_total", "Number of entries that were evicted, by cause.", "cause"),
+		entries:       desc("entries", "Number of entries in the cache."),
+		weight:        desc("weight", "Total weight of the entries in the cache."),
+		shardEntries:  desc("shard_entries", "Number of entries in a shard.", "shard"),
+		bucketSeconds: bucketSeconds,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.loads
+	ch <- c.loadDuration
+	ch <- c.evictions
+	ch <- c.entries
+	ch <- c.weight
+	ch <- c.shardEntries
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+
+	counter := func(desc *prometheus.Desc, value uint64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labelValues...)
+	}
+	gauge := func(desc *prometheus.Desc, value float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
+	}
+
+	counter(c.hits, stats.Hits)
+	counter(c.misses, stats.Misses)
+	counter(c.loads, stats.LoadSuccesses, "success")
+	counter(c.loads, stats.LoadFailures, "failure")
+	counter(c.evictions, stats.Evictions, ezcache.RemovalEvicted.String())
+	counter(c.evictions, stats.Expirations, ezcache.RemovalExpired.String())
+
+	// Prometheus buckets are cumulative.
+	buckets := make(map[float64]uint64, len(c.bucketSeconds))
+	var count uint64
+	for i, upperBound := range c.bucketSeconds {
+		count += stats.LoadTimes[i]
+		buckets[upperBound] = count
+	}
+	count += stats.LoadTimes[len(c.bucketSeconds)]
+	ch <- prometheus.MustNewConstHistogram(c.loadDuration, count, stats.TotalLoadTime.Seconds(), buckets)
+
+	gauge(c.entries, float64(c.cache.Len()))
+	gauge(c.weight, float64(c.cache.Weight()))
+	for shard, entries := range c.cache.ShardLens() {
+		gauge(c.shardEntries, float64(entries), strconv.Itoa(shard))
+	}
+}
@@ -0,0 +1,96 @@
+package prometheus
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/birdayz/ezcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+)
+
+func TestCollector(t *testing.T) {
+	cache := ezcache.NewBuilder[ezcache.IntKey, string]().Loader(func(key ezcache.IntKey) (string, error) {
+		if key < 0 {
+			return "", errors.New("negative key")
+		}
+		return "loaded", nil
+	}).Capacity(2).NumShards(2).Weigher(func(key ezcache.IntKey, value string) uint64 {
+		return uint64(len(value))
+	}).RecordStats().Build()
+
+	_, err := cache.Get(1)
+	assert.NilError(t, err)
+	_, err = cache.Get(1)
+	assert.NilError(t, err)
+	_, err = cache.Get(-1)
+	assert.Assert(t, err != nil)
+	// Each shard holds two entries, so one of these is evicted.
+	cache.Set(3, "abc")
+	cache.Set(5, "abc")
+
+	collector := NewCollector("test", cache)
+
+	expected := `
+# HELP ezcache_entries Number of entries in the cache.
+# TYPE ezcache_entries gauge
+ezcache_entries{cache="test"} 2
+# HELP ezcache_evictions_total Number of entries that were evicted, by cause.
+# TYPE ezcache_evictions_total counter
+ezcache_evictions_total{cache="test",cause="evicted"} 1
+ezcache_evictions_total{cache="test",cause="expired"} 0
+# HELP ezcache_hits_total Number of lookups that found a value.
+# TYPE ezcache_hits_total counter
+ezcache_hits_total{cache="test"} 1
+# HELP ezcache_loads_total Number of loads and refreshes, by result.
+# TYPE ezcache_loads_total counter
+ezcache_loads_total{cache="test",result="failure"} 1
+ezcache_loads_total{cache="test",result="success"} 1
+# HELP ezcache_misses_total Number of lookups that did not find a value.
+# TYPE ezcache_misses_total counter
+ezcache_misses_total{cache="test"} 2
+# HELP ezcache_shard_entries Number of entries in a shard.
+# TYPE ezcache_shard_entries gauge
+ezcache_shard_entries{cache="test",shard="0"} 0
+ezcache_shard_entries{cache="test",shard="1"} 2
+# HELP ezcache_weight Total weight of the entries in the cache.
+# TYPE ezcache_weight gauge
+ezcache_weight{cache="test"} 6
+`
+	assert.NilError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"ezcache_entries",
+		"ezcache_evictions_total",
+		"ezcache_hits_total",
+		"ezcache_loads_total",
+		"ezcache_misses_total",
+		"ezcache_shard_entries",
+		"ezcache_weight",
+	))
+
+	// Load times vary, only check that both loads were observed.
+	registry := prometheus.NewPedanticRegistry()
+	assert.NilError(t, registry.Register(collector))
+	families, err := registry.Gather()
+	assert.NilError(t, err)
+	for _, family := range families {
+		if family.GetName() == "ezcache_load_duration_seconds" {
+			histogram := family.GetMetric()[0].GetHistogram()
+			assert.Equal(t, histogram.GetSampleCount(), uint64(2))
+			assert.Equal(t, len(histogram.GetBucket()), len(ezcache.LoadTimeBuckets))
+			return
+		}
+	}
+	t.Fatal("ezcache_load_duration_seconds was not collected")
+}
+
+func TestCollectorMultipleCaches(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	assert.NilError(t, registry.Register(NewCollector("a", ezcache.NewBuilder[ezcache.IntKey, int]().Build())))
+	assert.NilError(t, registry.Register(NewCollector("b", ezcache.NewBuilder[ezcache.IntKey, int]().Build())))
+
+	count, err := testutil.GatherAndCount(registry, "ezcache_entries")
+	assert.NilError(t, err)
+	assert.Equal(t, count, 2)
+}
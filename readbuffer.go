@@ -0,0 +1,55 @@
+package ezcache
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// Number of reads a readBuffer holds. Must be a power of 2.
+const readBufferSize = 64
+
+// readBuffer records the entries that were read while only the read lock of
+// a shard was held, so the accesses can be replayed later in a batch, while
+// the lock is held. It is lossy: if the buffer is full, or another reader
+// races for the same slot, the read is dropped. Eviction policies only need
+// an approximation of the access pattern, so that is fine.
+type readBuffer[T any] struct {
+	// Only written while the lock is held.
+	head uint64
+	// Incremented by readers holding the read lock. Accessed atomically.
+	tail uint64
+
+	slots [readBufferSize]unsafe.Pointer
+}
+
+// add records item. It returns true if the buffer is full and should be
+// drained. The caller must hold the read lock or the lock.
+func (b *readBuffer[T]) add(item *T) bool {
+	head := atomic.LoadUint64(&b.head)
+	tail := atomic.LoadUint64(&b.tail)
+	if tail-head >= readBufferSize {
+		return true
+	}
+
+	if !atomic.CompareAndSwapUint64(&b.tail, tail, tail+1) {
+		return false
+	}
+	atomic.StorePointer(&b.slots[tail&(readBufferSize-1)], unsafe.Pointer(item))
+
+	return tail+1-head >= readBufferSize
+}
+
+// drain passes all recorded items to fn, and empties the buffer. The caller
+// must hold the lock, so no reader is adding items concurrently.
+func (b *readBuffer[T]) drain(fn func(*T)) {
+	head := b.head
+	tail := atomic.LoadUint64(&b.tail)
+	for ; head != tail; head++ {
+		slot := &b.slots[head&(readBufferSize-1)]
+		item := (*T)(atomic.LoadPointer(slot))
+		atomic.StorePointer(slot, nil)
+		fn(item)
+	}
+
+	atomic.StoreUint64(&b.head, head)
+}
@@ -0,0 +1,44 @@
+package ezcache
+
+// RemovalCause describes why an entry was removed from the cache.
+type RemovalCause int
+
+const (
+	// RemovalExplicit means that the entry was removed by the user, e.g. with
+	// Delete.
+	RemovalExplicit RemovalCause = iota
+	// RemovalReplaced means that the value of the entry was replaced, e.g. by
+	// Set or a refresh. The entry itself stays in the cache.
+	RemovalReplaced
+	// RemovalExpired means that the entry expired.
+	RemovalExpired
+	// RemovalEvicted means that the entry was evicted to make room for
+	// another one.
+	RemovalEvicted
+)
+
+func (c RemovalCause) String() string {
+	switch c {
+	case RemovalExplicit:
+		return "explicit"
+	case RemovalReplaced:
+		return "replaced"
+	case RemovalExpired:
+		return "expired"
+	case RemovalEvicted:
+		return "evicted"
+	default:
+		return "unknown"
+	}
+}
+
+// RemovalListener is notified whenever an entry leaves the cache, or its
+// value is replaced.
+type RemovalListener[K Key[K], V any] func(key K, value V, cause RemovalCause)
+
+// removal is a pending notification of a RemovalListener.
+type removal[K Key[K], V any] struct {
+	key   K
+	value V
+	cause RemovalCause
+}
@@ -1,14 +1,15 @@
 package ezcache
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	timeNow = time.Now
-)
-
 type shard[K interface {
 	Equals(K) bool
 	HashCoder
@@ -17,131 +18,1121 @@ type shard[K interface {
 
 	dataMap *HashMap[K, *cacheEntry[K, V]]
 
-	linkedList *List[K]
-	capacity   int
+	// Decides which entries to evict once the shard is full. Nil if the
+	// shard is unbounded. newPolicy creates a fresh one once the shard is
+	// cleared.
+	policy    EvictionPolicy[K]
+	newPolicy func() EvictionPolicy[K]
+	capacity  int
+
+	// Entries weigh 1, unless there is a weigher. If maxWeight is positive,
+	// entries are evicted once their total weight exceeds it.
+	weigher   func(K, V) uint64
+	maxWeight uint64
+	weight    uint64
 
+	// If the capacity is enforced across all shards, the budget shared with
+	// the other shards. Room for new entries is reserved in it before the
+	// lock is taken.
+	global *globalBudget[K, V]
+
+	// Timing wheel of entries that expire. It is only allocated once the
+	// first entry that expires is stored, so it costs nothing if entries
+	// never expire.
 	ttl  time.Duration
-	ttls *Heap[*cacheEntry[K, V]]
+	ttls *TimerWheel[*cacheEntry[K, V]]
+
+	// If positive, entries expire accessTTL after they were last read or
+	// written.
+	accessTTL time.Duration
+
+	// In-flight loads, keyed by the key being loaded. Used to make sure that
+	// concurrent misses on the same key only run the loader once.
+	loads *HashMap[K, *call[V]]
+
+	// Entries older than refreshAfter are reloaded in the background when
+	// they are read. Zero disables refreshing.
+	refreshAfter   time.Duration
+	onRefreshError func(key K, err error)
+
+	// Used instead of the loader to refresh entries, if set.
+	reloaderFn ReloaderFn[K, V]
+
+	removalListener     RemovalListener[K, V]
+	listenerOutsideLock bool
+	// Removals that happened while the lock was held, to be passed to the
+	// removal listener once it is released.
+	pendingRemovals []removal[K, V]
+
+	// Computes per-entry expiry. If nil, every entry expires ttl after it was
+	// written.
+	expiry Expiry[K, V]
+
+	clock Clock
+
+	// Entries that were read while only the read lock was held. The reads
+	// are replayed to the eviction policy and the TTL heap once the lock is
+	// taken.
+	reads readBuffer[cacheEntry[K, V]]
+
+	// Nil unless statistics are recorded.
+	stats *statsCounter
+
+	// Entries by tag. Nil until the first entry with tags is stored.
+	tags tagIndex[K, V]
+
+	// Version of the last write to the shard.
+	version uint64
+
+	// Index of the shard within the cache, and the instrumentation that is
+	// notified of loads, if any.
+	index           int
+	instrumentation Instrumentation
 }
 
 func newShard[K interface {
 	Equals(K) bool
 	HashCoder
 }, V any](capacity int, ttl time.Duration) *shard[K, V] {
-	var initialMapCapacity = capacity
+	s := &shard[K, V]{
+		m:        sync.RWMutex{},
+		capacity: capacity,
+		ttl:      ttl,
+		loads:    NewHashMap[K, *call[V]](16),
+		clock:    systemClock{},
+	}
+	s.dataMap = s.newDataMap()
+
+	if capacity > 0 {
+		s.newPolicy = func() EvictionPolicy[K] { return NewLRUPolicy[K](capacity) }
+		s.policy = s.newPolicy()
+	}
+
+	return s
+}
+
+func (s *shard[K, V]) newDataMap() *HashMap[K, *cacheEntry[K, V]] {
+	var initialMapCapacity = s.capacity
 	if initialMapCapacity < 16 {
 		initialMapCapacity = 16
 	}
 
-	return &shard[K, V]{
-		m:          sync.RWMutex{},
-		dataMap:    NewHashMap[K, *cacheEntry[K, V]](initialMapCapacity),
-		linkedList: NewList[K](),
-		capacity:   capacity,
-		ttl:        ttl,
-		ttls: NewHeap(func(t1, t2 *cacheEntry[K, V]) int {
-			if t1.expireAt > t2.expireAt {
-				return 1
-			} else if t1.expireAt < t2.expireAt {
-				return -1
-			}
+	return NewHashMap[K, *cacheEntry[K, V]](initialMapCapacity)
+}
+
+// lock acquires the lock, and replays the reads that were buffered since it
+// was last held.
+func (s *shard[K, V]) lock() {
+	s.m.Lock()
+	s.drainReads()
+}
+
+// unlock releases the lock. If the removal listener runs outside the lock,
+// it is notified about all removals that happened while the lock was held.
+func (s *shard[K, V]) unlock() {
+	if len(s.pendingRemovals) == 0 {
+		s.m.Unlock()
+		return
+	}
+
+	pending := s.pendingRemovals
+	s.pendingRemovals = nil
+	s.m.Unlock()
+
+	for _, r := range pending {
+		s.removalListener(r.key, r.value, r.cause)
+	}
+}
+
+// notifyRemoval passes a removal to the removal listener, either right away
+// or once the lock is released. The caller must hold the lock.
+func (s *shard[K, V]) notifyRemoval(key K, value V, cause RemovalCause) {
+	if s.removalListener == nil {
+		return
+	}
 
-			return 0
-		}, capacity),
+	if s.listenerOutsideLock {
+		s.pendingRemovals = append(s.pendingRemovals, removal[K, V]{key, value, cause})
+		return
 	}
+
+	s.removalListener(key, value, cause)
 }
 
 // set returns true if the value existed before
 func (s *shard[K, V]) set(key K, keyHash uint64, value V) {
-	s.m.Lock()
-	defer s.m.Unlock()
+	s.setWithTTL(key, keyHash, value, useDefaultTTL)
+}
+
+// setWithTTL is like set, but lets the entry expire after ttl. ttl overrides
+// both the TTL and the Expiry of the shard, unless it is useDefaultTTL.
+//
+// The entry carries the given tags, replacing the ones it had.
+func (s *shard[K, V]) setWithTTL(key K, keyHash uint64, value V, ttl time.Duration, tags ...string) {
+	weight := s.weigh(key, value)
+	s.reserve(weight)
+
+	s.lock()
+	defer s.unlock()
+
+	s.storeWithTTL(key, keyHash, value, weight, ttl, tags)
 
+	// A load that is still running for this key would overwrite the value
+	// that was just set with a potentially stale one. Forget about it, so its
+	// result is handed to its waiters but not written.
+	s.loads.DeleteH(key, keyHash)
+}
+
+// useDefaultTTL can be passed to storeWithTTL to have the expiry of the entry
+// computed from the shard's TTL or Expiry.
+const useDefaultTTL = time.Duration(math.MinInt64)
+
+// store inserts or updates the entry for key, which has the given weight. If
+// the shard shares a global budget, room for the entry must have been
+// reserved with reserve. The caller must hold the lock.
+func (s *shard[K, V]) store(key K, keyHash uint64, value V, weight uint64, tags []string) {
+	s.storeWithTTL(key, keyHash, value, weight, useDefaultTTL, tags)
+}
+
+// storeWithTTL is like store, but lets the entry expire after ttl, unless it
+// is useDefaultTTL. The caller must hold the lock.
+func (s *shard[K, V]) storeWithTTL(key K, keyHash uint64, value V, weight uint64, ttl time.Duration, tags []string) {
 	s.clean()
 
+	if s.tooHeavy(weight) {
+		// The entry would not fit even into an empty shard. Reject it, and
+		// drop the previous value, which would be stale otherwise. That
+		// removes the entry, so it is not a replacement.
+		s.remove(key, RemovalEvicted)
+		s.stats.recordRemoval(RemovalEvicted)
+		s.notifyRemoval(key, value, RemovalEvicted)
+		return
+	}
+
 	// This could be optimized with a very specific call that does the get and
 	// update at once
 	entry, ok := s.dataMap.GetH(key, keyHash)
 	if !ok {
 
-		if s.linkedList.Len() >= s.capacity {
-			keyToRemove := s.linkedList.Back()
-			s.delete(keyToRemove.Value)
-		}
-
 		// Not found
-		newElement := s.linkedList.PushFront(key)
-
+		now := s.clock.Now()
 		newItem := cacheEntry[K, V]{
-			value:       value,
-			expireAt:    timeNow().Add(s.ttl).UnixMilli(),
-			node:        newElement,
-			heapElement: nil,
+			key:        key,
+			value:      value,
+			insertedAt: now.UnixMilli(),
+			writtenAt:  now.UnixMilli(),
+			expireAt:   neverExpires,
+			weight:     weight,
 		}
 
-		newHeapItem := s.ttls.Push(&newItem)
-		newItem.heapElement = newHeapItem
+		s.setExpireAt(&newItem, s.expireAfterCreate(key, value, now, ttl), now)
+		s.setTags(&newItem, tags)
+		s.version++
+		newItem.version = s.version
 		s.dataMap.SetH(key, &newItem, keyHash)
+		s.weight += weight
+		if s.global != nil {
+			atomic.AddInt64(&s.global.stored, 1)
+			newItem.usedAt = s.global.use()
+		}
+
+		if s.policy != nil {
+			newItem.policyEntry = &PolicyEntry[K]{Key: key, Hash: keyHash}
+			s.policy.OnInsert(newItem.policyEntry)
+			s.evict()
+		}
 
 		return
 
 	} else {
-		entry.expireAt = timeNow().Add(s.ttl).UnixMilli() // TODO: store ttls somewhere else, not in the map entry
+		now := s.clock.Now()
+		entry.writtenAt = now.UnixMilli()
+		s.setExpireAt(entry, s.expireAfterUpdate(key, value, entry, now, ttl), now) // TODO: store ttls somewhere else, not in the map entry
+		s.notifyRemoval(key, entry.value, RemovalReplaced)
 		entry.value = value
-		s.ttls.Fix(entry.heapElement)
+		s.setTags(entry, tags)
+		s.version++
+		entry.version = s.version
+		if s.global != nil {
+			// The entry already had room reserved for it.
+			s.global.release(1, entry.weight)
+		}
+		s.weight = s.weight - entry.weight + weight
+		entry.weight = weight
+		if s.global != nil {
+			entry.usedAt = s.global.use()
+		}
 		// Es wird ein bereits removed ding wieder benutzt
-		s.linkedList.MoveToFront(entry.node)
+		if s.policy != nil {
+			s.policy.OnAccess(entry.policyEntry)
+		}
 		s.dataMap.SetH(key, entry, keyHash)
+
+		// The new value may be heavier than the old one.
+		if s.policy != nil {
+			s.evict()
+		}
+	}
+}
+
+// weigh returns the weight of an entry.
+func (s *shard[K, V]) weigh(key K, value V) uint64 {
+	if s.weigher == nil {
+		return 1
+	}
+
+	return s.weigher(key, value)
+}
+
+// tooHeavy returns true if an entry of the given weight would not fit even
+// into an empty shard.
+func (s *shard[K, V]) tooHeavy(weight uint64) bool {
+	if s.global != nil {
+		return s.global.tooHeavy(weight)
+	}
+
+	return s.maxWeight > 0 && weight > s.maxWeight
+}
+
+// reserve reserves room in the global budget for an entry of the given
+// weight that is about to be stored, evicting entries from any shard if
+// necessary. If the entry turns out to replace an existing one, store gives
+// the room back. The caller must not hold the lock.
+func (s *shard[K, V]) reserve(weight uint64) {
+	if s.global != nil {
+		s.global.reserve(weight)
+	}
+}
+
+// unreserve gives back room that was reserved, but not used. The caller must
+// not hold the lock.
+func (s *shard[K, V]) unreserve(weight uint64) {
+	if s.global != nil && !s.global.tooHeavy(weight) {
+		s.global.release(1, weight)
+	}
+}
+
+// victimUsedAt returns when the entry that the eviction policy would evict
+// next was last used. It returns false if the shard is empty. The policy is
+// only peeked at, as the victim may not be evicted after all. If the policy
+// can't be peeked at, the victim counts as just used, so that the shard is
+// only evicted from if no other one can be.
+func (s *shard[K, V]) victimUsedAt() (uint64, bool) {
+	s.lock()
+	defer s.unlock()
+
+	if s.dataMap.Len() == 0 {
+		return 0, false
+	}
+
+	peeker, ok := s.policy.(victimPeeker[K])
+	if !ok {
+		return math.MaxUint64, true
+	}
+
+	victim := peeker.PeekVictim()
+	entry, ok := s.dataMap.GetH(victim.Key, victim.Hash)
+	if !ok {
+		panic("bug - eviction policy returned a victim that is not in the shard")
+	}
+
+	return entry.usedAt, true
+}
+
+// evictOne removes expired entries, or evicts the victim chosen by the
+// eviction policy if there are none. It returns false if the shard is empty.
+func (s *shard[K, V]) evictOne() bool {
+	s.lock()
+	defer s.unlock()
+
+	size := s.dataMap.Len()
+	if s.clean(); s.dataMap.Len() < size {
+		return true
+	}
+
+	if size == 0 {
+		return false
+	}
+
+	victim := s.policy.Victim()
+	if !s.remove(victim.Key, RemovalEvicted) {
+		panic("bug - eviction policy returned a victim that is not in the shard")
+	}
+
+	return true
+}
+
+// setExpireAt sets the expire-after-write deadline of entry, and reschedules
+// it. If expire-after-access is enabled, the entry may expire earlier. The
+// caller must hold the lock.
+func (s *shard[K, V]) setExpireAt(entry *cacheEntry[K, V], writeExpireAt int64, now time.Time) {
+	atomic.StoreInt64(&entry.writeExpireAt, writeExpireAt)
+	s.access(entry, now)
+	s.scheduleExpiry(entry)
+}
+
+// access restarts the expire-after-access timer of entry. Whichever of its
+// expire-after-write and expire-after-access deadlines comes first wins. The
+// entry is not rescheduled. The caller must hold the lock or the read lock.
+func (s *shard[K, V]) access(entry *cacheEntry[K, V], now time.Time) {
+	expireAt := atomic.LoadInt64(&entry.writeExpireAt)
+	if s.accessTTL > 0 {
+		if accessExpireAt := now.Add(s.accessTTL).UnixMilli(); accessExpireAt < expireAt {
+			expireAt = accessExpireAt
+		}
+	}
+
+	atomic.StoreInt64(&entry.expireAt, expireAt)
+}
+
+// evict removes the victims chosen by the eviction policy until the shard is
+// within its capacity and weight budget. Depending on the policy, the entry
+// that was just added may be evicted itself. The caller must hold the lock.
+func (s *shard[K, V]) evict() {
+	for s.overCapacity() {
+		victim := s.policy.Victim()
+		if !s.remove(victim.Key, RemovalEvicted) {
+			panic("bug - eviction policy returned a victim that is not in the shard")
+		}
+	}
+}
+
+// overCapacity returns true if the shard holds more entries, or more weight,
+// than it may. The caller must hold the lock.
+func (s *shard[K, V]) overCapacity() bool {
+	if s.capacity > 0 && s.dataMap.Len() > s.capacity {
+		return true
+	}
+
+	return s.maxWeight > 0 && s.weight > s.maxWeight
+}
+
+// scheduleExpiry updates the position of entry in the timing wheel after its
+// expireAt changed. Entries that never expire are not kept in the wheel. The
+// caller must hold the lock.
+func (s *shard[K, V]) scheduleExpiry(entry *cacheEntry[K, V]) {
+	expireAt := atomic.LoadInt64(&entry.expireAt)
+	if expireAt == neverExpires {
+		if entry.timer != nil {
+			s.ttls.Remove(entry.timer)
+			entry.timer = nil
+		}
+		return
+	}
+
+	if entry.timer == nil {
+		if s.ttls == nil {
+			s.ttls = NewTimerWheel[*cacheEntry[K, V]](s.clock.Now().UnixMilli())
+		}
+		entry.timer = s.ttls.Schedule(entry, expireAt)
+		return
+	}
+
+	if entry.timer.at != expireAt {
+		s.ttls.Reschedule(entry.timer, expireAt)
+	}
+}
+
+func (s *shard[K, V]) expireAfterCreate(key K, value V, now time.Time, ttl time.Duration) int64 {
+	switch {
+	case ttl != useDefaultTTL:
+		return expireAtAfter(now, ttl)
+	case s.expiry != nil:
+		return expireAtAfter(now, s.expiry.ExpireAfterCreate(key, value))
+	default:
+		return expireAtAfter(now, s.ttl)
+	}
+}
+
+// expireAfterUpdate returns the expireAt timestamp of entry, after its value
+// is replaced with value.
+func (s *shard[K, V]) expireAfterUpdate(key K, value V, entry *cacheEntry[K, V], now time.Time, ttl time.Duration) int64 {
+	switch {
+	case ttl != useDefaultTTL:
+		return expireAtAfter(now, ttl)
+	case s.expiry != nil:
+		return expireAtAfter(now, s.expiry.ExpireAfterUpdate(key, value, remaining(now, atomic.LoadInt64(&entry.writeExpireAt))))
+	default:
+		return expireAtAfter(now, s.ttl)
 	}
 }
 
+// onRead updates the access statistics and expiry of entry after it was
+// read. The caller must hold the lock or the read lock. If it only holds the
+// read lock, it must record the read with recordRead, otherwise apply it with
+// replayRead.
+func (s *shard[K, V]) onRead(key K, entry *cacheEntry[K, V]) {
+	if s.global != nil {
+		atomic.StoreUint64(&entry.usedAt, s.global.use())
+	}
+
+	now := s.clock.Now()
+	atomic.AddUint64(&entry.hits, 1)
+	atomic.StoreInt64(&entry.accessedAt, now.UnixMilli())
+
+	if s.expiry != nil || s.accessTTL > 0 {
+		if s.expiry != nil {
+			current := remaining(now, atomic.LoadInt64(&entry.writeExpireAt))
+			if d := s.expiry.ExpireAfterRead(key, entry.value, current); d != current {
+				atomic.StoreInt64(&entry.writeExpireAt, expireAtAfter(now, d))
+			}
+		}
+		s.access(entry, now)
+	}
+}
+
+// recordRead buffers a read of entry, to be replayed once the lock is taken.
+// It returns true if the buffer is full and should be drained. The caller
+// must hold the read lock.
+func (s *shard[K, V]) recordRead(entry *cacheEntry[K, V]) bool {
+	if s.policy == nil && s.expiry == nil && s.accessTTL <= 0 {
+		return false
+	}
+
+	return s.reads.add(entry)
+}
+
+// replayRead passes a read of entry to the eviction policy, and reschedules
+// its expiry. The caller must hold the lock.
+func (s *shard[K, V]) replayRead(entry *cacheEntry[K, V]) {
+	if s.policy != nil {
+		s.policy.OnAccess(entry.policyEntry)
+	}
+	s.scheduleExpiry(entry)
+}
+
+// drainReads replays the buffered reads. As the buffer is drained whenever
+// the lock is taken, none of the entries can have been removed in the
+// meantime. The caller must hold the lock.
+func (s *shard[K, V]) drainReads() {
+	s.reads.drain(s.replayRead)
+}
+
+// Maximum number of expired entries that a single call to clean removes. If
+// more entries expired, they are removed by the following calls, or by the
+// janitor.
+const cleanBatchSize = 64
+
+// clean removes up to cleanBatchSize expired entries, so callers never pay
+// for purging a large number of entries at once. The caller must hold the
+// lock.
 func (s *shard[K, V]) clean() {
+	s.cleanUpTo(cleanBatchSize)
+}
+
+// cleanUpTo removes up to limit expired entries. Entries whose expiry was
+// moved by reads that were not replayed yet are rescheduled instead, which
+// counts towards the limit as well. It returns true if no expired entries are
+// left. The caller must hold the lock.
+func (s *shard[K, V]) cleanUpTo(limit int) bool {
+	if s.ttls == nil {
+		return true
+	}
+
+	now := s.clock.Now().UnixMilli()
+	s.ttls.Advance(now)
+	for i := 0; i < limit; i++ {
+		timer := s.ttls.Peek()
+		if timer == nil {
+			return true
+		}
+
+		entry := timer.Item
+		if atomic.LoadInt64(&entry.expireAt) > now {
+			s.scheduleExpiry(entry)
+			continue
+		}
+
+		if !s.remove(entry.key, RemovalExpired) {
+			panic("bug - delete was unsuccessful. This means that fundamental invariants are broken, and the cache's internal state is most likely not consistent anymore")
+		}
+	}
+
+	return s.ttls.Peek() == nil
+}
+
+// cleanAll removes all expired entries, in batches of cleanBatchSize. The
+// lock is released between batches, so other callers are not blocked for
+// long.
+func (s *shard[K, V]) cleanAll() {
 	for {
-		if len(s.ttls.data) == 0 {
+		s.lock()
+		done := s.cleanUpTo(cleanBatchSize)
+		s.unlock()
+
+		if done {
 			return
 		}
+	}
+}
 
-		item := s.ttls.Peek()
-		if item.Item.expireAt <= timeNow().UnixMilli() {
-			// remove item
-			res := s.delete(item.Item.node.Value)
-			if !res {
-				panic("bug - delete was unsuccessful. This means that fundamental invariants are broken, and the cache's internal state is most likely not consistent anymore")
-			}
-		} else {
-			return
+// expired returns true if entry expired at now, but may not have been
+// removed yet. The caller must hold the lock or the read lock.
+func (s *shard[K, V]) expired(entry *cacheEntry[K, V], now int64) bool {
+	return atomic.LoadInt64(&entry.expireAt) <= now
+}
+
+// needsClean returns true if there are entries that are due to be removed
+// by clean. The caller must hold the lock or the read lock.
+func (s *shard[K, V]) needsClean(now int64) bool {
+	return s.ttls != nil && s.ttls.Due(now)
+}
+
+// getShared looks up key while only holding the read lock, so that readers
+// do not block each other. If handled is false, the lookup has to be
+// repeated with the lock held: either expired entries need to be removed
+// first, or the entry is due for a refresh.
+func (s *shard[K, V]) getShared(key K, keyHash uint64) (value V, found, handled bool) {
+	s.m.RLock()
+
+	// Without a timing wheel, no entry expires.
+	var now int64
+	if s.ttls != nil {
+		now = s.clock.Now().UnixMilli()
+		if s.needsClean(now) {
+			s.m.RUnlock()
+			return *new(V), false, false
 		}
 	}
+
+	entry, ok := s.dataMap.GetH(key, keyHash)
+	if !ok {
+		s.m.RUnlock()
+		return *new(V), false, true
+	}
+
+	if (s.ttls != nil && s.expired(entry, now)) || s.needsRefresh(entry) {
+		s.m.RUnlock()
+		return *new(V), false, false
+	}
+
+	value = entry.value
+	s.onRead(key, entry)
+	full := s.recordRead(entry)
+	s.m.RUnlock()
+
+	// If someone else holds the lock, they drain the buffer once they
+	// release it.
+	if full && s.m.TryLock() {
+		s.drainReads()
+		s.unlock()
+	}
+
+	return value, true, true
 }
 
 func (s *shard[K, V]) get(key K, keyHash uint64) (V, bool) {
-	s.m.Lock()
-	defer s.m.Unlock()
+	if value, found, handled := s.getShared(key, keyHash); handled {
+		if found {
+			s.stats.recordHit()
+		} else {
+			s.stats.recordMiss()
+		}
+		return value, found
+	}
+
+	s.lock()
+	defer s.unlock()
 
 	s.clean()
 
-	data, ok := s.dataMap.GetH(key, keyHash)
+	return s.getLocked(key, keyHash)
+}
+
+// getLocked is like get, but the caller must hold the lock.
+func (s *shard[K, V]) getLocked(key K, keyHash uint64) (V, bool) {
+	data, ok := s.lookup(key, keyHash)
 	if !ok {
+		s.stats.recordMiss()
 		return *new(V), false
 	}
 
-	s.linkedList.MoveToFront(data.node)
+	s.stats.recordHit()
+	s.onReadLocked(key, data)
 	return data.value, true
+}
+
+// lookup returns the entry for key. An entry that expired, but was not
+// removed by clean because a read moved its expiry closer, is removed. The
+// caller must hold the lock.
+func (s *shard[K, V]) lookup(key K, keyHash uint64) (*cacheEntry[K, V], bool) {
+	entry, ok := s.dataMap.GetH(key, keyHash)
+	if ok && s.ttls != nil && s.expired(entry, s.clock.Now().UnixMilli()) {
+		s.remove(key, RemovalExpired)
+		return nil, false
+	}
+
+	return entry, ok
+}
+
+// onReadLocked is like onRead, but applies the read right away. The caller
+// must hold the lock.
+func (s *shard[K, V]) onReadLocked(key K, entry *cacheEntry[K, V]) {
+	s.onRead(key, entry)
+	s.replayRead(entry)
+}
+
+// load returns the value for key. If it is not cached, loaderFn is run to
+// obtain it. Concurrent loads of the same key are deduplicated: only the first
+// caller starts loaderFn, all others wait for it and receive the same value or
+// error. A successfully loaded value is written to the shard exactly once.
+//
+// The loader runs with a context that carries the values of the context of
+// the caller that started it. It is cancelled once every caller waiting for
+// the load has given up, but not before.
+//
+// Besides the value, load returns how it was obtained, and the error.
+func (s *shard[K, V]) load(ctx context.Context, key K, keyHash uint64, loaderFn LoaderCtxFn[K, V]) (V, GetResult) {
+	if value, found, _ := s.getShared(key, keyHash); found {
+		s.stats.recordHit()
+		return value, GetResult{Hit: true}
+	}
+
+	s.lock()
+
+	s.clean()
+
+	value, found, c, started := s.getOrReserve(ctx, key, keyHash, func() *call[V] { return newCall[V](ctx) })
+	s.unlock()
+	if found {
+		if started {
+			go s.backgroundRefresh(c, key, keyHash, value, loaderFn)
+		}
+		return value, GetResult{Hit: true}
+	}
 
+	if started {
+		go s.runLoad(c, key, keyHash, loaderFn)
+	}
+
+	value, err := s.wait(ctx, key, keyHash, c)
+	return value, GetResult{Shared: !started, Err: err}
+}
+
+// getOrReserve looks up key. On a miss, it joins the in-flight load of key, or
+// registers a new one created by newCallFn. If started is true, the caller is
+// responsible for running the load and passing its result to finishLoad.
+// Either way, the caller is counted as a waiter of c.
+//
+// On a hit of an entry that is due for a refresh, a refresh call with a
+// context derived from ctx is registered: found and started are both true,
+// and the caller is responsible for running it with backgroundRefresh.
+//
+// The caller must hold the lock.
+func (s *shard[K, V]) getOrReserve(ctx context.Context, key K, keyHash uint64, newCallFn func() *call[V]) (value V, found bool, c *call[V], started bool) {
+	if data, ok := s.lookup(key, keyHash); ok {
+		s.stats.recordHit()
+		s.onReadLocked(key, data)
+
+		if s.needsRefresh(data) {
+			if current, loading := s.loads.GetH(key, keyHash); !loading || current.cancelled() {
+				c = newCall[V](ctx)
+				// The refresh is its own waiter without a deadline, so it
+				// is not cancelled if a caller that joined it gives up.
+				c.join(context.Background())
+				s.loads.SetH(key, c, keyHash)
+				return data.value, true, c, true
+			}
+		}
+
+		return data.value, true, nil, false
+	}
+
+	s.stats.recordMiss()
+
+	c, ok := s.loads.GetH(key, keyHash)
+	if !ok || c.cancelled() {
+		// A cancelled load would only fail this caller as well.
+		c = newCallFn()
+		s.loads.SetH(key, c, keyHash)
+		started = true
+	}
+	c.join(ctx)
+
+	return *new(V), false, c, started
+}
+
+// wait blocks until c, the load of key, has completed or ctx is done. A
+// caller that gives up does not abort the load, unless it was the last one
+// waiting for it.
+func (s *shard[K, V]) wait(ctx context.Context, key K, keyHash uint64, c *call[V]) (V, error) {
+	select {
+	case <-c.done:
+		return c.value, c.err
+	case <-ctx.Done():
+		s.abandon(key, keyHash, c)
+		return *new(V), ctx.Err()
+	}
+}
+
+// abandon stops waiting for c, the load of key. The load is cancelled if
+// nobody else is waiting for it, and forgotten, so that the next miss of key
+// starts a new one instead of joining it.
+func (s *shard[K, V]) abandon(key K, keyHash uint64, c *call[V]) {
+	s.lock()
+	defer s.unlock()
+
+	c.waiters--
+	if c.waiters > 0 {
+		return
+	}
+
+	c.cancel()
+	if current, ok := s.loads.GetH(key, keyHash); ok && current == c {
+		s.loads.DeleteH(key, keyHash)
+	}
+}
+
+func (s *shard[K, V]) runLoad(c *call[V], key K, keyHash uint64, loaderFn LoaderCtxFn[K, V]) {
+	defer c.cancel()
+
+	ctx, end := s.startLoad(c.ctx, LoadInfo{KeyHash: keyHash, Shard: s.index, Keys: 1})
+	value, err := callLoader(ctx, key, loaderFn)
+	end(err)
+	if err != nil {
+		err = fmt.Errorf("failed to run loader: %w", err)
+	}
+
+	s.finishLoad(c, key, keyHash, value, err)
+}
+
+// refresh reloads the entry for key, or loads it if it is not cached. If a
+// load of key is already in flight, refresh waits for it instead of starting
+// another one.
+func (s *shard[K, V]) refresh(ctx context.Context, key K, keyHash uint64, loaderFn LoaderCtxFn[K, V]) error {
+	s.lock()
+
+	s.clean()
+
+	c, loading := s.loads.GetH(key, keyHash)
+	if loading && !c.cancelled() {
+		c.join(ctx)
+		s.unlock()
+		_, err := s.wait(ctx, key, keyHash, c)
+		return err
+	}
+
+	data, found := s.dataMap.GetH(key, keyHash)
+	switch {
+	case found && (s.reloaderFn != nil || loaderFn != nil):
+		c = newCall[V](ctx)
+		// Join before the load starts, so it sees the deadline of ctx.
+		c.join(ctx)
+		go s.runRefresh(c, key, keyHash, data.value, loaderFn)
+	case !found && loaderFn != nil:
+		c = newCall[V](ctx)
+		c.join(ctx)
+		go s.runLoad(c, key, keyHash, loaderFn)
+	case found:
+		// Nothing to reload it with, keep the value as it is.
+		s.unlock()
+		return nil
+	default:
+		s.unlock()
+		return ErrNotFound
+	}
+	s.loads.SetH(key, c, keyHash)
+	s.unlock()
+
+	_, err := s.wait(ctx, key, keyHash, c)
+	return err
+}
+
+// refreshDue starts a refresh of every entry that is due for one, and
+// returns the calls of these refreshes, and of those that were in flight
+// already. The caller must not hold the lock.
+func (s *shard[K, V]) refreshDue(loaderFn LoaderCtxFn[K, V]) []*call[V] {
+	if s.refreshAfter <= 0 || (s.reloaderFn == nil && loaderFn == nil) {
+		return nil
+	}
+
+	s.lock()
+	defer s.unlock()
+
+	var calls []*call[V]
+	s.dataMap.rangeH(func(key K, entry *cacheEntry[K, V], keyHash uint64) bool {
+		if !s.needsRefresh(entry) {
+			return true
+		}
+
+		if c, loading := s.loads.GetH(key, keyHash); loading && !c.cancelled() {
+			calls = append(calls, c)
+			return true
+		}
+
+		c := newCall[V](context.Background())
+		c.join(context.Background())
+		s.loads.SetH(key, c, keyHash)
+		go s.backgroundRefresh(c, key, keyHash, entry.value, loaderFn)
+		calls = append(calls, c)
+		return true
+	})
+
+	return calls
+}
+
+// backgroundRefresh runs a refresh registered by getOrReserve. If it fails,
+// the current value is kept and the error is reported to onRefreshError.
+func (s *shard[K, V]) backgroundRefresh(c *call[V], key K, keyHash uint64, old V, loaderFn LoaderCtxFn[K, V]) {
+	s.runRefresh(c, key, keyHash, old, loaderFn)
+
+	if c.err != nil && s.onRefreshError != nil {
+		s.onRefreshError(key, c.err)
+	}
+}
+
+// runRefresh reloads an entry whose current value is old, using the reloader
+// if there is one, and the loader otherwise. If the reloader reports that the
+// value is unchanged, only the entry's expiry is reset.
+func (s *shard[K, V]) runRefresh(c *call[V], key K, keyHash uint64, old V, loaderFn LoaderCtxFn[K, V]) {
+	defer c.cancel()
+
+	var (
+		value V
+		err   error
+	)
+	ctx, end := s.startLoad(c.ctx, LoadInfo{KeyHash: keyHash, Shard: s.index, Refresh: true, Keys: 1})
+	if s.reloaderFn != nil {
+		value, err = callReloader(ctx, key, old, s.reloaderFn)
+	} else {
+		value, err = callLoader(ctx, key, loaderFn)
+	}
+	if errors.Is(err, ErrUnchanged) {
+		end(nil)
+	} else {
+		end(err)
+	}
+
+	if errors.Is(err, ErrUnchanged) {
+		s.finishUnchanged(c, key, keyHash, old)
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("failed to refresh: %w", err)
+	}
+
+	s.finishLoad(c, key, keyHash, value, err)
+}
+
+// startLoad is called before the load described by info runs. The load must
+// run with the returned context, and pass its error to end once it returned.
+func (s *shard[K, V]) startLoad(ctx context.Context, info LoadInfo) (_ context.Context, end func(error)) {
+	endInstrumentation := func(error) {}
+	if s.instrumentation != nil {
+		ctx, endInstrumentation = s.instrumentation.StartLoad(ctx, info)
+	}
+
+	start := time.Now()
+	return ctx, func(err error) {
+		s.stats.recordLoad(time.Since(start), err)
+		endInstrumentation(err)
+	}
+}
+
+// finishUnchanged completes a refresh that did not change the value. The
+// entry is kept, but counts as freshly written.
+func (s *shard[K, V]) finishUnchanged(c *call[V], key K, keyHash uint64, old V) {
+	s.lock()
+	value := old
+	if current, ok := s.loads.GetH(key, keyHash); ok && current == c {
+		s.loads.DeleteH(key, keyHash)
+		if data, ok := s.dataMap.GetH(key, keyHash); ok {
+			s.touch(key, data)
+			value = data.value
+		}
+	}
+	s.unlock()
+
+	c.complete(value, nil)
+}
+
+// touch resets the write time and expiry of entry, without changing its
+// value. The caller must hold the lock.
+func (s *shard[K, V]) touch(key K, entry *cacheEntry[K, V]) {
+	now := s.clock.Now()
+	entry.writtenAt = now.UnixMilli()
+	s.setExpireAt(entry, s.expireAfterUpdate(key, entry.value, entry, now, useDefaultTTL), now)
+}
+
+// needsRefresh returns true if entry is old enough to be refreshed. The
+// caller must hold the lock.
+func (s *shard[K, V]) needsRefresh(entry *cacheEntry[K, V]) bool {
+	if s.refreshAfter <= 0 {
+		return false
+	}
+
+	return s.clock.Now().UnixMilli()-entry.writtenAt >= s.refreshAfter.Milliseconds()
+}
+
+// finishLoad writes the result of a load started via getOrReserve, and hands
+// it to everyone waiting for it.
+func (s *shard[K, V]) finishLoad(c *call[V], key K, keyHash uint64, value V, err error) {
+	var weight uint64
+	if err == nil {
+		weight = s.weigh(key, value)
+		s.reserve(weight)
+	}
+
+	s.lock()
+	// The call may have been superseded by a Set or Delete in the meantime;
+	// in that case the loaded value must not be written.
+	stored := false
+	if current, ok := s.loads.GetH(key, keyHash); ok && current == c {
+		s.loads.DeleteH(key, keyHash)
+		if err == nil {
+			s.store(key, keyHash, value, weight, s.loadedTags(c, key, keyHash))
+			stored = true
+		}
+	}
+	s.unlock()
+
+	if err == nil && !stored {
+		s.unreserve(weight)
+	}
+
+	c.complete(value, err)
+}
+
+// loadedTags returns the tags of the entry loaded by c: the ones the loader
+// attached, or else the ones of the entry it reloaded. The caller must hold
+// the lock.
+func (s *shard[K, V]) loadedTags(c *call[V], key K, keyHash uint64) []string {
+	if tags := tagsOf(c.ctx); len(tags) > 0 {
+		return tags
+	}
+
+	// Expired entries are not reloaded, but loaded anew.
+	s.clean()
+	if entry, ok := s.dataMap.GetH(key, keyHash); ok {
+		return entry.tags
+	}
+
+	return nil
 }
 
 func (s *shard[K, V]) Delete(key K) bool {
-	s.m.Lock()
-	defer s.m.Unlock()
+	s.lock()
+	defer s.unlock()
+
+	s.loads.Delete(key)
 
 	return s.delete(key)
 }
 
+// Len returns the number of entries in the shard.
+func (s *shard[K, V]) Len() int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.dataMap.Len()
+}
+
+// Weight returns the total weight of the entries in the shard.
+func (s *shard[K, V]) Weight() uint64 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.weight
+}
+
+// appendEntries appends the keys and values of all entries that did not
+// expire at now to entries. The caller must hold the lock or the read lock.
+func (s *shard[K, V]) appendEntries(entries []entry[K, V], now int64) []entry[K, V] {
+	s.dataMap.rangeH(func(key K, data *cacheEntry[K, V], hash uint64) bool {
+		if s.ttls == nil || !s.expired(data, now) {
+			entries = append(entries, entry[K, V]{key, data.value, hash})
+		}
+		return true
+	})
+
+	return entries
+}
+
+// clear removes all entries. Instead of removing them one by one, the map,
+// eviction policy and timing wheel of the shard are replaced, so it takes
+// constant time unless notify is true: then the removal listener is notified
+// of each entry with RemovalExplicit. Loads that are in flight are forgotten,
+// so their results are not written.
+func (s *shard[K, V]) clear(notify bool) {
+	s.lock()
+	defer s.unlock()
+
+	old := s.dataMap
+	s.dataMap = s.newDataMap()
+	s.loads = NewHashMap[K, *call[V]](16)
+	if s.newPolicy != nil {
+		s.policy = s.newPolicy()
+	}
+	// Allocated again once an entry that expires is stored.
+	s.ttls = nil
+	s.tags = nil
+
+	if s.global != nil {
+		atomic.AddInt64(&s.global.stored, -int64(old.Len()))
+		s.global.release(int64(old.Len()), s.weight)
+	}
+	s.weight = 0
+
+	if notify && s.removalListener != nil {
+		old.Range(func(key K, data *cacheEntry[K, V]) bool {
+			s.notifyRemoval(key, data.value, RemovalExplicit)
+			return true
+		})
+	}
+}
+
+// invalidateIf removes all entries that did not expire and for which fn
+// returns true, and returns their number. fn is called while the lock is held.
+func (s *shard[K, V]) invalidateIf(fn func(K, V) bool) int {
+	s.lock()
+	defer s.unlock()
+
+	var now int64
+	if s.ttls != nil {
+		now = s.clock.Now().UnixMilli()
+	}
+
+	var keys []K
+	s.dataMap.Range(func(key K, data *cacheEntry[K, V]) bool {
+		if (s.ttls == nil || !s.expired(data, now)) && fn(key, data.value) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	for _, key := range keys {
+		s.loads.Delete(key)
+		s.delete(key)
+	}
+
+	return len(keys)
+}
+
 func (s *shard[K, V]) delete(key K) bool {
+	return s.remove(key, RemovalExplicit)
+}
+
+// remove deletes the entry for key, and notifies the removal listener with
+// cause. The caller must hold the lock.
+func (s *shard[K, V]) remove(key K, cause RemovalCause) bool {
 	oldVal, deleted := s.dataMap.Delete(key)
 
 	if deleted {
-		s.linkedList.Remove(oldVal.node)
-		s.ttls.Remove(oldVal.heapElement)
+		s.weight -= oldVal.weight
+		if s.global != nil {
+			atomic.AddInt64(&s.global.stored, -1)
+			s.global.release(1, oldVal.weight)
+		}
+		s.untag(oldVal)
+		s.stats.recordRemoval(cause)
+		s.notifyRemoval(key, oldVal.value, cause)
+		if s.policy != nil {
+			s.policy.OnRemove(oldVal.policyEntry)
+		}
+		if oldVal.timer != nil {
+			s.ttls.Remove(oldVal.timer)
+		}
 		return true
 	}
 
@@ -154,13 +1145,44 @@ type cacheEntry[K interface {
 	HashCoder
 	Equals(K) bool
 }, V any] struct {
+	key   K
 	value V
 
-	expireAt int64 // exact timestamp, at which the entry is considered expired
+	insertedAt int64 // timestamp of the first write
+	writtenAt  int64 // timestamp of the last write, used for refreshing
+
+	// Timestamp of the last read, and the number of reads. Accessed
+	// atomically.
+	accessedAt int64
+	hits       uint64
+
+	// Exact timestamp, at which the entry is considered expired. Readers
+	// holding only the read lock may move it, so it is accessed atomically.
+	expireAt int64
+
+	// Deadline set by the TTL or Expiry. Unless expire-after-access moves
+	// it closer, this is the same as expireAt. Accessed atomically.
+	writeExpireAt int64
+
+	// Weight of the entry, as computed by the weigher when it was written
+	weight uint64
+
+	// When the entry was last used, on the clock of the global budget.
+	// Accessed atomically.
+	usedAt uint64
+
+	// Handle of the entry in the eviction policy
+	policyEntry *PolicyEntry[K]
+
+	// Tags the entry carries, each at most once
+	tags []string
 
-	// LinkedList node pointer, used for LRU eviction
-	node *Element[K]
+	// Incremented on every write. Versions are unique within a shard, so a
+	// key that is deleted and written again does not get an old version.
+	version uint64
 
-	// Pointer to heap item, used for TTL
-	heapElement *HeapElement[*cacheEntry[K, V]]
+	// Position of the entry in the timing wheel, if it expires. It is
+	// scheduled at the expireAt the entry had when the reads that moved it
+	// were last replayed.
+	timer *TimerElement[*cacheEntry[K, V]]
 }
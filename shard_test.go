@@ -1,9 +1,11 @@
 package ezcache
 
 import (
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/birdayz/ezcache/clocktest"
 	"gotest.tools/v3/assert"
 )
 
@@ -151,21 +153,13 @@ func TestExpireTTL(t *testing.T) {
 	shard := newShard[StringKey, string](10, time.Hour*1)
 	shard.ttl = time.Millisecond * 10
 
-	var fakeTime time.Time
-
-	// "Inject" fake time
-	timeFn := func() time.Time {
-		return fakeTime
-	}
-	timeNow = timeFn
-	defer func() { timeNow = time.Now }()
-
-	fakeTime = time.Now()
+	clock := clocktest.NewClock(time.Now())
+	shard.clock = clock
 
 	abc := StringKey("abc")
 	shard.set("abc", abc.HashCode(), "def")
 
-	fakeTime = fakeTime.Add(time.Millisecond * 11)
+	clock.Advance(time.Millisecond * 11)
 
 	_, ok := shard.get(abc, abc.HashCode())
 	assert.Equal(t, ok, false)
@@ -175,28 +169,20 @@ func TestExpireTTL(t *testing.T) {
 func TestExpireTTLProlongedAfterSet(t *testing.T) {
 	shard := newShard[StringKey, string](10, time.Millisecond*10)
 
-	var fakeTime time.Time
-
-	// "Inject" fake time
-	timeFn := func() time.Time {
-		return fakeTime
-	}
-	timeNow = timeFn
-	defer func() { timeNow = time.Now }()
-
-	fakeTime = time.Now()
+	clock := clocktest.NewClock(time.Now())
+	shard.clock = clock
 
 	abc := StringKey("abc")
 	def := StringKey("def")
 	shard.set("abc", abc.HashCode(), "def")
 	shard.set(def, def.HashCode(), "def2")
 
-	fakeTime = fakeTime.Add(time.Millisecond * 5)
+	clock.Advance(time.Millisecond * 5)
 	_, ok := shard.get("abc", abc.HashCode())
 	assert.Equal(t, ok, true)
 
 	shard.set("abc", abc.HashCode(), "defNew")
-	fakeTime = fakeTime.Add(time.Millisecond * 5)
+	clock.Advance(time.Millisecond * 5)
 
 	// Check if the first item, which was touched, is still around
 	_, ok = shard.get("abc", abc.HashCode())
@@ -210,16 +196,8 @@ func TestExpireTTLProlongedAfterSet(t *testing.T) {
 func TestExpireTTLExact(t *testing.T) {
 	shard := newShard[StringKey, string](10, time.Millisecond*1)
 
-	var fakeTime time.Time
-
-	// "Inject" fake time
-	timeFn := func() time.Time {
-		return fakeTime
-	}
-	timeNow = timeFn
-	defer func() { timeNow = time.Now }()
-
-	fakeTime = time.Now()
+	clock := clocktest.NewClock(time.Now())
+	shard.clock = clock
 
 	abc := StringKey("abc")
 	shard.set(abc, abc.HashCode(), "def")
@@ -227,9 +205,270 @@ func TestExpireTTLExact(t *testing.T) {
 	_, ok := shard.get(abc, abc.HashCode())
 	assert.Equal(t, ok, true)
 
-	fakeTime = fakeTime.Add(time.Millisecond * 1)
+	clock.Advance(time.Millisecond * 1)
 
 	// Check if the first item, which was touched, is still around
 	_, ok = shard.get("abc", abc.HashCode())
 	assert.Equal(t, ok, false)
 }
+
+func TestNoTTLDoesNotUseHeap(t *testing.T) {
+	shard := newShard[IntKey, int](10, 0)
+
+	clock := clocktest.NewClock(time.Now())
+	shard.clock = clock
+
+	for i := 0; i < 5; i++ {
+		shard.set(IntKey(i), IntKey(i).HashCode(), i)
+	}
+	shard.set(IntKey(0), IntKey(0).HashCode(), 100)
+
+	clock.Advance(time.Hour * 24 * 365)
+
+	for i := 1; i < 5; i++ {
+		res, ok := shard.get(IntKey(i), IntKey(i).HashCode())
+		assert.Equal(t, ok, true)
+		assert.Equal(t, res, i)
+	}
+	res, ok := shard.get(IntKey(0), IntKey(0).HashCode())
+	assert.Equal(t, ok, true)
+	assert.Equal(t, res, 100)
+
+	assert.Assert(t, shard.ttls == nil)
+
+	// LRU eviction still works
+	shard.set(IntKey(5), IntKey(5).HashCode(), 5)
+	shard.set(IntKey(6), IntKey(6).HashCode(), 6)
+	shard.set(IntKey(7), IntKey(7).HashCode(), 6)
+	shard.set(IntKey(8), IntKey(8).HashCode(), 6)
+	shard.set(IntKey(9), IntKey(9).HashCode(), 6)
+	shard.set(IntKey(10), IntKey(10).HashCode(), 6)
+	_, ok = shard.get(IntKey(1), IntKey(1).HashCode())
+	assert.Equal(t, ok, false)
+}
+
+func TestUnboundedCapacity(t *testing.T) {
+	shard := newShard[IntKey, int](0, time.Millisecond*10)
+
+	clock := clocktest.NewClock(time.Now())
+	shard.clock = clock
+
+	for i := 0; i < 1000; i++ {
+		shard.set(IntKey(i), IntKey(i).HashCode(), i)
+	}
+
+	for i := 0; i < 1000; i++ {
+		res, ok := shard.get(IntKey(i), IntKey(i).HashCode())
+		assert.Equal(t, ok, true)
+		assert.Equal(t, res, i)
+	}
+
+	// Entries still expire
+	clock.Advance(time.Millisecond * 10)
+	_, ok := shard.get(IntKey(0), IntKey(0).HashCode())
+	assert.Equal(t, ok, false)
+
+	// A single call only removes a batch of them.
+	assert.Equal(t, shard.ttls.Len(), 1000-cleanBatchSize)
+	shard.cleanAll()
+	assert.Equal(t, shard.ttls.Len(), 0)
+	assert.Equal(t, shard.Len(), 0)
+}
+
+func TestSetWithTTLOnShardWithoutTTL(t *testing.T) {
+	shard := newShard[IntKey, int](10, 0)
+
+	clock := clocktest.NewClock(time.Now())
+	shard.clock = clock
+
+	shard.set(IntKey(0), IntKey(0).HashCode(), 0)
+	shard.setWithTTL(IntKey(1), IntKey(1).HashCode(), 1, time.Millisecond*10)
+	assert.Equal(t, shard.ttls.Len(), 1)
+
+	clock.Advance(time.Millisecond * 10)
+	_, ok := shard.get(IntKey(1), IntKey(1).HashCode())
+	assert.Equal(t, ok, false)
+	_, ok = shard.get(IntKey(0), IntKey(0).HashCode())
+	assert.Equal(t, ok, true)
+
+	// Setting an entry without TTL removes it from the heap
+	shard.setWithTTL(IntKey(2), IntKey(2).HashCode(), 2, time.Millisecond*10)
+	shard.set(IntKey(2), IntKey(2).HashCode(), 2)
+	assert.Equal(t, shard.ttls.Len(), 0)
+}
+
+func TestExpireAfterAccess(t *testing.T) {
+	shard := newShard[StringKey, string](10, 0)
+	shard.accessTTL = time.Millisecond * 10
+
+	clock := clocktest.NewClock(time.Now())
+	shard.clock = clock
+
+	abc := StringKey("abc")
+	def := StringKey("def")
+	shard.set(abc, abc.HashCode(), "val1")
+	shard.set(def, def.HashCode(), "val2")
+
+	// Keep reading abc, it should never expire
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Millisecond * 6)
+		_, ok := shard.get(abc, abc.HashCode())
+		assert.Equal(t, ok, true)
+	}
+
+	// def was not touched since it was set
+	_, ok := shard.get(def, def.HashCode())
+	assert.Equal(t, ok, false)
+
+	clock.Advance(time.Millisecond * 10)
+	_, ok = shard.get(abc, abc.HashCode())
+	assert.Equal(t, ok, false)
+}
+
+func TestExpireAfterAccessAndWrite(t *testing.T) {
+	shard := newShard[StringKey, string](10, time.Millisecond*20)
+	shard.accessTTL = time.Millisecond * 10
+
+	clock := clocktest.NewClock(time.Now())
+	shard.clock = clock
+
+	abc := StringKey("abc")
+	shard.set(abc, abc.HashCode(), "val1")
+
+	// Reads keep the entry alive, but only until its TTL is reached
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Millisecond * 6)
+		_, ok := shard.get(abc, abc.HashCode())
+		assert.Equal(t, ok, true)
+	}
+
+	clock.Advance(time.Millisecond * 2)
+	_, ok := shard.get(abc, abc.HashCode())
+	assert.Equal(t, ok, false)
+}
+
+func TestTinyLFUScanResistant(t *testing.T) {
+	shard := newShard[IntKey, int](100, time.Hour)
+	shard.policy = NewTinyLFUPolicy[IntKey](100)
+
+	// Make keys 0-49 frequent
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			if _, ok := shard.get(IntKey(i), IntKey(i).HashCode()); !ok {
+				shard.set(IntKey(i), IntKey(i).HashCode(), i)
+			}
+		}
+	}
+
+	// Scan over many keys that are used once
+	for i := 1000; i < 10000; i++ {
+		shard.set(IntKey(i), IntKey(i).HashCode(), i)
+	}
+
+	// With LRU, none of the frequent keys would survive the scan
+	survived := 0
+	for i := 0; i < 50; i++ {
+		if _, ok := shard.get(IntKey(i), IntKey(i).HashCode()); ok {
+			survived++
+		}
+	}
+	assert.Assert(t, survived >= 45, survived)
+	assert.Equal(t, shard.dataMap.Len(), 100)
+}
+
+func TestBufferedReadsReplayed(t *testing.T) {
+	shard := newShard[IntKey, int](3, time.Hour)
+	for i := 0; i < 3; i++ {
+		shard.set(IntKey(i), IntKey(i).HashCode(), i)
+	}
+
+	// More reads than the buffer holds, so it is drained in between.
+	for i := 0; i < readBufferSize*3; i++ {
+		_, ok := shard.get(0, IntKey(0).HashCode())
+		assert.Equal(t, ok, true)
+	}
+	_, ok := shard.get(2, IntKey(2).HashCode())
+	assert.Equal(t, ok, true)
+
+	// The reads are replayed before the write, so 1 is the least recently
+	// used entry.
+	shard.set(3, IntKey(3).HashCode(), 3)
+	_, ok = shard.get(1, IntKey(1).HashCode())
+	assert.Equal(t, ok, false)
+	_, ok = shard.get(0, IntKey(0).HashCode())
+	assert.Equal(t, ok, true)
+}
+
+func TestSharedReadWithoutExpiry(t *testing.T) {
+	shard := newShard[IntKey, int](10, 0)
+	shard.set(1, IntKey(1).HashCode(), 1)
+
+	// Entries that never expire are served under the read lock.
+	value, found, handled := shard.getShared(1, IntKey(1).HashCode())
+	assert.Equal(t, value, 1)
+	assert.Equal(t, found, true)
+	assert.Equal(t, handled, true)
+}
+
+func TestConcurrentReadsExpireAfterAccess(t *testing.T) {
+	shard := newShard[IntKey, int](100, time.Hour)
+	shard.accessTTL = time.Hour
+	for i := 0; i < 100; i++ {
+		shard.set(IntKey(i), IntKey(i).HashCode(), i)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				key := IntKey((g + i) % 100)
+				if i%100 == 0 {
+					shard.set(key, key.HashCode(), int(key))
+					continue
+				}
+				res, ok := shard.get(key, key.HashCode())
+				assert.Equal(t, ok, true)
+				assert.Equal(t, res, int(key))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// All buffered reads are replayed, and left the timing wheel consistent.
+	shard.lock()
+	defer shard.unlock()
+	assert.Equal(t, shard.ttls.Len(), 100)
+	for i := 0; i < 100; i++ {
+		entry, ok := shard.dataMap.Get(IntKey(i))
+		assert.Assert(t, ok)
+		assert.Equal(t, entry.timer.at, entry.expireAt)
+	}
+}
+
+func TestTagIndexConsistent(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	shard := newShard[IntKey, int](2, time.Second)
+	shard.clock = clock
+
+	shard.setWithTTL(1, IntKey(1).HashCode(), 1, useDefaultTTL, "a", "b")
+	shard.setWithTTL(2, IntKey(2).HashCode(), 2, useDefaultTTL, "a", "a")
+	assert.Equal(t, len(shard.tags["a"]), 2)
+
+	// Eviction removes 1 from the index.
+	shard.setWithTTL(3, IntKey(3).HashCode(), 3, useDefaultTTL, "c")
+	assert.Equal(t, len(shard.tags["a"]), 1)
+	_, ok := shard.tags["b"]
+	assert.Equal(t, ok, false)
+
+	// So do replacing, deleting and expiring entries.
+	shard.set(2, IntKey(2).HashCode(), 2)
+	shard.Delete(3)
+	shard.setWithTTL(4, IntKey(4).HashCode(), 4, useDefaultTTL, "d")
+	clock.Advance(time.Second)
+	shard.cleanAll()
+
+	assert.Equal(t, len(shard.tags), 0)
+	assert.Equal(t, shard.dataMap.Len(), 0)
+}
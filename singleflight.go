@@ -0,0 +1,252 @@
+package ezcache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// call is an in-flight or completed load of a single key. All callers that
+// miss on the same key while the load is running wait for the same call and
+// share its result.
+type call[V any] struct {
+	done chan struct{}
+
+	// Context passed to the loader, and a func to cancel it once nobody is
+	// interested in the result anymore.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The context ctx is derived from, which follows the deadlines of the
+	// waiters. Calls loaded by the same bulk loader call share it.
+	load *loadContext
+
+	// Number of callers waiting for the result. Guarded by the shard lock.
+	waiters int
+
+	value V
+	err   error
+}
+
+func newCall[V any](parent context.Context) *call[V] {
+	load := newLoadContext(parent)
+	return &call[V]{
+		done:   make(chan struct{}),
+		ctx:    withLoadTags(load),
+		cancel: func() { load.cancel(context.Canceled) },
+		load:   load,
+	}
+}
+
+// join counts a caller whose context is ctx as a waiter of c. The deadline of
+// the load is extended to the one of ctx, if it is later. The caller must hold
+// the shard lock.
+func (c *call[V]) join(ctx context.Context) {
+	c.waiters++
+	c.load.join(ctx)
+}
+
+// callGroup creates calls that are loaded together by a single bulk loader
+// call, and therefore share one loader context. That context is cancelled
+// once each of the calls lost all its waiters.
+type callGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	load   *loadContext
+
+	pending int32
+}
+
+func newCallGroup(parent context.Context) *callGroup {
+	load := newLoadContext(parent)
+	return &callGroup{
+		ctx:    withLoadTags(load),
+		cancel: func() { load.cancel(context.Canceled) },
+		load:   load,
+	}
+}
+
+func newGroupCall[V any](g *callGroup) *call[V] {
+	atomic.AddInt32(&g.pending, 1)
+
+	var once sync.Once
+	return &call[V]{
+		done: make(chan struct{}),
+		ctx:  g.ctx,
+		load: g.load,
+		cancel: func() {
+			once.Do(func() {
+				if atomic.AddInt32(&g.pending, -1) == 0 {
+					g.cancel()
+				}
+			})
+		},
+	}
+}
+
+// cancelled returns true if the load was cancelled, because all of its
+// waiters gave up or their deadline passed. It can't succeed anymore, so new
+// callers must not join it.
+func (c *call[V]) cancelled() bool {
+	return c.load.Err() != nil
+}
+
+// complete stores the result and releases all waiters.
+func (c *call[V]) complete(value V, err error) {
+	c.value = value
+	c.err = err
+	close(c.done)
+}
+
+// callLoader runs loaderFn, turning a panic into an error. The loader runs on
+// its own goroutine, so a panic could otherwise not be handled by any caller.
+func callLoader[K Key[K], V any](ctx context.Context, key K, loaderFn LoaderCtxFn[K, V]) (value V, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("loader panicked: %v", r)
+		}
+	}()
+
+	return loaderFn(ctx, key)
+}
+
+// callReloader is like callLoader, for reloaders.
+func callReloader[K Key[K], V any](ctx context.Context, key K, old V, reloaderFn ReloaderFn[K, V]) (value V, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reloader panicked: %v", r)
+		}
+	}()
+
+	return reloaderFn(ctx, key, old)
+}
+
+// callBulkLoader is like callLoader, for bulk loaders.
+func callBulkLoader[K Key[K], V any](ctx context.Context, keys []K, bulkLoaderFn BulkLoaderFn[K, V]) (values *HashMap[K, V], err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("bulk loader panicked: %v", r)
+		}
+	}()
+
+	values, err = bulkLoaderFn(ctx, keys)
+	if err == nil && values == nil {
+		values = NewHashMap[K, V](1)
+	}
+
+	return values, err
+}
+
+// loadContext is the context loads run with. It carries the values of the
+// context of the caller that started the load, but is not cancelled with it:
+// loads are shared by several callers, and one caller giving up must not
+// abort the load for everyone else. Instead, it is cancelled once all of them
+// gave up.
+//
+// Its deadline is the latest deadline of the callers waiting for the load,
+// so that it reaches e.g. the database call made by the loader. If one of
+// them has no deadline, neither has the load.
+type loadContext struct {
+	parent context.Context
+	done   chan struct{}
+
+	mu sync.Mutex
+	// Whether a waiter joined yet.
+	joined bool
+	// Zero if there is no deadline.
+	deadline time.Time
+	timer    *time.Timer
+	err      error
+}
+
+func newLoadContext(parent context.Context) *loadContext {
+	return &loadContext{
+		parent: parent,
+		done:   make(chan struct{}),
+	}
+}
+
+func (l *loadContext) Deadline() (deadline time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.deadline, !l.deadline.IsZero()
+}
+
+func (l *loadContext) Done() <-chan struct{} { return l.done }
+
+func (l *loadContext) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.err
+}
+
+func (l *loadContext) Value(key any) any { return l.parent.Value(key) }
+
+// join extends the deadline to the one of ctx, the context of a new waiter.
+func (l *loadContext) join(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case l.err != nil:
+		return
+	case !l.joined:
+		l.joined = true
+	case l.deadline.IsZero():
+		// Another waiter has no deadline.
+		return
+	case ok && !deadline.After(l.deadline):
+		return
+	}
+
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.deadline = time.Time{}
+	if ok {
+		l.deadline = deadline
+		l.timer = time.AfterFunc(time.Until(deadline), l.expire)
+	}
+}
+
+// expire cancels the context with context.DeadlineExceeded, if the deadline
+// passed. It may have been extended since the timer was started.
+func (l *loadContext) expire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.deadline.IsZero() && !time.Now().Before(l.deadline) {
+		l.cancelLocked(context.DeadlineExceeded)
+	}
+}
+
+// cancel cancels the context with err, unless it is done already.
+func (l *loadContext) cancel(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cancelLocked(err)
+}
+
+func (l *loadContext) cancelLocked(err error) {
+	if l.err != nil {
+		return
+	}
+
+	// The waiters may have given up because of the deadline, before the
+	// timer fired.
+	if !l.deadline.IsZero() && !time.Now().Before(l.deadline) {
+		err = context.DeadlineExceeded
+	}
+	l.err = err
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	close(l.done)
+}
@@ -0,0 +1,85 @@
+package ezcache
+
+// countMinSketch estimates how often keys were seen, using 4-bit counters.
+// To let the estimate adapt to a changing workload, all counters are halved
+// once a number of increments proportional to the capacity was recorded.
+//
+// See "TinyLFU: A Highly Efficient Cache Admission Policy" by Gil Einziger,
+// Roy Friedman and Ben Manes.
+type countMinSketch struct {
+	// depth rows of width counters each, stored one counter per byte.
+	counters []uint8
+	mask     uint64
+
+	additions  int
+	sampleSize int
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCounter = 15
+)
+
+// Seeds for the hash functions of each row.
+var sketchSeeds = [sketchDepth]uint64{
+	0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325,
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := 16
+	for width < capacity {
+		width *= 2
+	}
+
+	return &countMinSketch{
+		counters:   make([]uint8, sketchDepth*width),
+		mask:       uint64(width - 1),
+		sampleSize: 10 * width,
+	}
+}
+
+// index returns the position of the counter for hash in the given row.
+func (c *countMinSketch) index(hash uint64, row int) int {
+	h := (hash + sketchSeeds[row]) * sketchSeeds[(row+1)%sketchDepth]
+	h ^= h >> 32
+	return row*int(c.mask+1) + int(h&c.mask)
+}
+
+// increment records an occurrence of hash.
+func (c *countMinSketch) increment(hash uint64) {
+	added := false
+	for row := 0; row < sketchDepth; row++ {
+		i := c.index(hash, row)
+		if c.counters[i] < sketchMaxCounter {
+			c.counters[i]++
+			added = true
+		}
+	}
+
+	if added {
+		c.additions++
+		if c.additions >= c.sampleSize {
+			c.reset()
+		}
+	}
+}
+
+// estimate returns the estimated number of occurrences of hash.
+func (c *countMinSketch) estimate(hash uint64) int {
+	lowest := uint8(sketchMaxCounter)
+	for row := 0; row < sketchDepth; row++ {
+		if v := c.counters[c.index(hash, row)]; v < lowest {
+			lowest = v
+		}
+	}
+
+	return int(lowest)
+}
+
+// reset ages all counters by halving them.
+func (c *countMinSketch) reset() {
+	for i := range c.counters {
+		c.counters[i] >>= 1
+	}
+	c.additions /= 2
+}
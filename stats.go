@@ -0,0 +1,201 @@
+package ezcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the statistics of a cache. Statistics are only
+// recorded if the cache was built with RecordStats.
+type Stats struct {
+	// Number of lookups that found a value, and that did not.
+	Hits   uint64
+	Misses uint64
+
+	// Number of loads and refreshes that succeeded or failed, and the total
+	// time spent running them.
+	LoadSuccesses uint64
+	LoadFailures  uint64
+	TotalLoadTime time.Duration
+	// Histogram of the time loads took. LoadTimes[i] is the number of loads
+	// that took longer than LoadTimeBuckets[i-1], but at most
+	// LoadTimeBuckets[i]. The last element counts all slower loads.
+	LoadTimes [len(LoadTimeBuckets) + 1]uint64
+
+	// Number of entries that were evicted to make room for others, and that
+	// expired.
+	Evictions   uint64
+	Expirations uint64
+}
+
+// LoadTimeBuckets are the upper bounds of the buckets of Stats.LoadTimes.
+var LoadTimeBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Requests returns the number of lookups.
+func (s Stats) Requests() uint64 {
+	return s.Hits + s.Misses
+}
+
+// HitRatio returns the share of lookups that found a value. It is 1 if there
+// were no lookups.
+func (s Stats) HitRatio() float64 {
+	if s.Requests() == 0 {
+		return 1
+	}
+
+	return float64(s.Hits) / float64(s.Requests())
+}
+
+// MissRatio returns the share of lookups that did not find a value. It is 0
+// if there were no lookups.
+func (s Stats) MissRatio() float64 {
+	if s.Requests() == 0 {
+		return 0
+	}
+
+	return float64(s.Misses) / float64(s.Requests())
+}
+
+// Loads returns the number of loads and refreshes.
+func (s Stats) Loads() uint64 {
+	return s.LoadSuccesses + s.LoadFailures
+}
+
+// LoadFailureRatio returns the share of loads that failed. It is 0 if there
+// were no loads.
+func (s Stats) LoadFailureRatio() float64 {
+	if s.Loads() == 0 {
+		return 0
+	}
+
+	return float64(s.LoadFailures) / float64(s.Loads())
+}
+
+// AverageLoadPenalty returns the average time a load took. It is 0 if there
+// were no loads.
+func (s Stats) AverageLoadPenalty() time.Duration {
+	if s.Loads() == 0 {
+		return 0
+	}
+
+	return s.TotalLoadTime / time.Duration(s.Loads())
+}
+
+// Minus returns the difference between s and an earlier snapshot, i.e. the
+// statistics of the interval between them. Counters that would be negative
+// are 0.
+func (s Stats) Minus(earlier Stats) Stats {
+	var loadTimes [len(s.LoadTimes)]uint64
+	for i := range loadTimes {
+		loadTimes[i] = minus(s.LoadTimes[i], earlier.LoadTimes[i])
+	}
+
+	return Stats{
+		Hits:          minus(s.Hits, earlier.Hits),
+		Misses:        minus(s.Misses, earlier.Misses),
+		LoadSuccesses: minus(s.LoadSuccesses, earlier.LoadSuccesses),
+		LoadFailures:  minus(s.LoadFailures, earlier.LoadFailures),
+		TotalLoadTime: time.Duration(minus(uint64(s.TotalLoadTime), uint64(earlier.TotalLoadTime))),
+		LoadTimes:     loadTimes,
+		Evictions:     minus(s.Evictions, earlier.Evictions),
+		Expirations:   minus(s.Expirations, earlier.Expirations),
+	}
+}
+
+func minus(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+
+	return a - b
+}
+
+// statsCounter records the statistics of a shard. Each shard has its own, so
+// that they do not contend with each other. All methods can be called on a
+// nil counter, and do nothing then.
+type statsCounter struct {
+	// Accessed atomically.
+	hits          uint64
+	misses        uint64
+	loadSuccesses uint64
+	loadFailures  uint64
+	totalLoadTime uint64
+	loadTimes     [len(LoadTimeBuckets) + 1]uint64
+	evictions     uint64
+	expirations   uint64
+}
+
+func (c *statsCounter) recordHit() {
+	if c != nil {
+		atomic.AddUint64(&c.hits, 1)
+	}
+}
+
+func (c *statsCounter) recordMiss() {
+	if c != nil {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+// recordLoad records a load that took d, and failed if err is not nil.
+func (c *statsCounter) recordLoad(d time.Duration, err error) {
+	if c == nil {
+		return
+	}
+
+	if err != nil {
+		atomic.AddUint64(&c.loadFailures, 1)
+	} else {
+		atomic.AddUint64(&c.loadSuccesses, 1)
+	}
+	atomic.AddUint64(&c.totalLoadTime, uint64(d))
+
+	bucket := 0
+	for bucket < len(LoadTimeBuckets) && d > LoadTimeBuckets[bucket] {
+		bucket++
+	}
+	atomic.AddUint64(&c.loadTimes[bucket], 1)
+}
+
+func (c *statsCounter) recordRemoval(cause RemovalCause) {
+	if c == nil {
+		return
+	}
+
+	switch cause {
+	case RemovalEvicted:
+		atomic.AddUint64(&c.evictions, 1)
+	case RemovalExpired:
+		atomic.AddUint64(&c.expirations, 1)
+	}
+}
+
+// addTo adds the recorded statistics to stats.
+func (c *statsCounter) addTo(stats *Stats) {
+	if c == nil {
+		return
+	}
+
+	stats.Hits += atomic.LoadUint64(&c.hits)
+	stats.Misses += atomic.LoadUint64(&c.misses)
+	stats.LoadSuccesses += atomic.LoadUint64(&c.loadSuccesses)
+	stats.LoadFailures += atomic.LoadUint64(&c.loadFailures)
+	stats.TotalLoadTime += time.Duration(atomic.LoadUint64(&c.totalLoadTime))
+	for i := range c.loadTimes {
+		stats.LoadTimes[i] += atomic.LoadUint64(&c.loadTimes[i])
+	}
+	stats.Evictions += atomic.LoadUint64(&c.evictions)
+	stats.Expirations += atomic.LoadUint64(&c.expirations)
+}
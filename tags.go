@@ -0,0 +1,127 @@
+package ezcache
+
+import (
+	"context"
+	"sync"
+)
+
+// tagIndex maps each tag to the entries carrying it.
+type tagIndex[K Key[K], V any] map[string]map[*cacheEntry[K, V]]struct{}
+
+// loadTags collects the tags that a loader attaches with AddTags.
+type loadTags struct {
+	mu   sync.Mutex
+	tags []string
+}
+
+type loadTagsKey struct{}
+
+// withLoadTags returns a context that collects the tags a loader running
+// with it attaches.
+func withLoadTags(ctx context.Context) context.Context {
+	return context.WithValue(ctx, loadTagsKey{}, &loadTags{})
+}
+
+// AddTags attaches tags to the entry that is being loaded. It must be called
+// with the context passed to a loader, reloader or bulk loader, and does
+// nothing otherwise. Tags attached by a bulk loader apply to every entry it
+// loads in the same call. If a reload or refresh does not attach any tags,
+// the entry keeps the ones it had.
+func AddTags(ctx context.Context, tags ...string) {
+	lt, ok := ctx.Value(loadTagsKey{}).(*loadTags)
+	if !ok {
+		return
+	}
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.tags = append(lt.tags, tags...)
+}
+
+// tagsOf returns the tags attached with AddTags to ctx.
+func tagsOf(ctx context.Context) []string {
+	lt, ok := ctx.Value(loadTagsKey{}).(*loadTags)
+	if !ok {
+		return nil
+	}
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.tags
+}
+
+// setTags replaces the tags of entry. The caller must hold the lock.
+func (s *shard[K, V]) setTags(entry *cacheEntry[K, V], tags []string) {
+	s.untag(entry)
+	if len(tags) == 0 {
+		return
+	}
+
+	if s.tags == nil {
+		s.tags = make(tagIndex[K, V])
+	}
+
+	entry.tags = make([]string, 0, len(tags))
+	for _, tag := range tags {
+		entries, ok := s.tags[tag]
+		if !ok {
+			entries = make(map[*cacheEntry[K, V]]struct{})
+			s.tags[tag] = entries
+		}
+		if _, ok := entries[entry]; ok {
+			// Tagged twice.
+			continue
+		}
+		entries[entry] = struct{}{}
+		entry.tags = append(entry.tags, tag)
+	}
+}
+
+// untag removes entry from the tag index. The caller must hold the lock.
+func (s *shard[K, V]) untag(entry *cacheEntry[K, V]) {
+	for _, tag := range entry.tags {
+		entries := s.tags[tag]
+		delete(entries, entry)
+		if len(entries) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+	entry.tags = nil
+}
+
+// invalidateTag removes all entries carrying tag, and returns the number of
+// entries that did not expire yet.
+func (s *shard[K, V]) invalidateTag(tag string) int {
+	s.lock()
+	defer s.unlock()
+
+	entries := s.tags[tag]
+	if len(entries) == 0 {
+		return 0
+	}
+
+	var now int64
+	if s.ttls != nil {
+		now = s.clock.Now().UnixMilli()
+	}
+
+	// Removing the entries modifies the index.
+	tagged := make([]*cacheEntry[K, V], 0, len(entries))
+	for entry := range entries {
+		tagged = append(tagged, entry)
+	}
+
+	removed := 0
+	for _, entry := range tagged {
+		if s.ttls != nil && s.expired(entry, now) {
+			s.remove(entry.key, RemovalExpired)
+			continue
+		}
+
+		s.loads.Delete(entry.key)
+		s.delete(entry.key)
+		removed++
+	}
+
+	return removed
+}
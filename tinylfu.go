@@ -0,0 +1,114 @@
+package ezcache
+
+// tinyLFUPolicy implements the W-TinyLFU eviction policy.
+//
+// See "TinyLFU: A Highly Efficient Cache Admission Policy" by Gil Einziger,
+// Roy Friedman and Ben Manes.
+type tinyLFUPolicy[K any] struct {
+	window    *List[*PolicyEntry[K]]
+	probation *List[*PolicyEntry[K]]
+	protected *List[*PolicyEntry[K]]
+
+	maxWindow    int
+	maxProtected int
+
+	sketch *countMinSketch
+}
+
+// NewTinyLFUPolicy returns a W-TinyLFU policy. New entries enter a small LRU
+// admission window. Entries that fall out of the window become candidates for
+// the main area, which is a segmented LRU of a probation and a protected
+// segment. A candidate is only admitted if it was used more often than the
+// entry it would replace, as estimated by a count-min sketch. This keeps a
+// burst of keys that are used once, like a scan, from flushing the entries
+// that are used frequently.
+func NewTinyLFUPolicy[K any](capacity int) EvictionPolicy[K] {
+	maxWindow := capacity / 100
+	if maxWindow < 1 {
+		maxWindow = 1
+	}
+	maxMain := capacity - maxWindow
+
+	return &tinyLFUPolicy[K]{
+		window:       NewList[*PolicyEntry[K]](),
+		probation:    NewList[*PolicyEntry[K]](),
+		protected:    NewList[*PolicyEntry[K]](),
+		maxWindow:    maxWindow,
+		maxProtected: maxMain * 8 / 10,
+		sketch:       newCountMinSketch(capacity),
+	}
+}
+
+// OnInsert adds a new entry to the admission window. Entries that overflow
+// the window are moved into the probation segment.
+func (p *tinyLFUPolicy[K]) OnInsert(e *PolicyEntry[K]) {
+	p.sketch.increment(e.Hash)
+
+	e.segment = segmentWindow
+	e.element = p.window.PushFront(e)
+
+	for p.window.Len() > p.maxWindow {
+		overflow := p.window.Back()
+		overflow.Value.segment = segmentProbation
+		moveToFront(overflow, p.window, p.probation)
+	}
+}
+
+func (p *tinyLFUPolicy[K]) OnAccess(e *PolicyEntry[K]) {
+	p.sketch.increment(e.Hash)
+
+	switch e.segment {
+	case segmentWindow:
+		p.window.MoveToFront(e.element)
+	case segmentProbation:
+		e.segment = segmentProtected
+		moveToFront(e.element, p.probation, p.protected)
+
+		// Make room in the protected segment by demoting its least recently
+		// used entry.
+		if p.protected.Len() > p.maxProtected {
+			demoted := p.protected.Back()
+			demoted.Value.segment = segmentProbation
+			moveToFront(demoted, p.protected, p.probation)
+		}
+	case segmentProtected:
+		p.protected.MoveToFront(e.element)
+	}
+}
+
+func (p *tinyLFUPolicy[K]) OnRemove(e *PolicyEntry[K]) {
+	switch e.segment {
+	case segmentWindow:
+		p.window.Remove(e.element)
+	case segmentProbation:
+		p.probation.Remove(e.element)
+	case segmentProtected:
+		p.protected.Remove(e.element)
+	}
+}
+
+func (p *tinyLFUPolicy[K]) Victim() *PolicyEntry[K] {
+	// The most recent arrival to the probation segment is the candidate,
+	// competing with the least recently used entry of the main area.
+	candidate := p.probation.Front()
+	victim := p.probation.Back()
+	if victim == nil || victim == candidate {
+		if p.protected.Len() > 0 {
+			victim = p.protected.Back()
+		} else if victim == nil {
+			return p.window.Back().Value
+		}
+	}
+
+	if candidate == nil || candidate == victim {
+		return victim.Value
+	}
+
+	if p.sketch.estimate(candidate.Value.Hash) > p.sketch.estimate(victim.Value.Hash) {
+		return victim.Value
+	}
+
+	return candidate.Value
+}
+
+func (p *tinyLFUPolicy[K]) PeekVictim() *PolicyEntry[K] { return p.Victim() }
@@ -0,0 +1,247 @@
+package ezcache
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	wheelBits   = 6
+	wheelSize   = 1 << wheelBits
+	wheelLevels = 6
+)
+
+// TimerElement is an item scheduled in a TimerWheel.
+type TimerElement[T any] struct {
+	Item T
+
+	at int64
+
+	// Position in the wheel. level is -1 once the item is due.
+	level   int
+	bucket  int
+	element *Element[*TimerElement[T]]
+}
+
+// TimerWheel is a hierarchical timing wheel, which schedules items at
+// timestamps in milliseconds. Unlike a Heap, scheduling and removing an item
+// is O(1).
+//
+// The wheel has wheelLevels levels of wheelSize buckets each. A bucket on
+// level l spans 64^l milliseconds, so the levels cover about 64 ms, 4 s,
+// 4 min, 4.7 h, 12 days and 2 years. Items are put into the bucket of the
+// finest level that can hold them. As time advances, the buckets that were
+// passed are emptied: due items are moved to a list of due items, all others
+// move on to a finer level. Each item is therefore touched at most once per
+// level.
+type TimerWheel[T any] struct {
+	// The time up to which buckets were advanced.
+	time int64
+
+	levels [wheelLevels]timerLevel[T]
+	due    List[*TimerElement[T]]
+	len    int
+
+	// Lower bound of the time at which the next item becomes due.
+	next int64
+}
+
+type timerLevel[T any] struct {
+	// Allocated on first use.
+	buckets [wheelSize]*List[*TimerElement[T]]
+	// Bit i is set if bucket i is not empty.
+	occupied uint64
+}
+
+// NewTimerWheel returns an empty wheel, starting at now.
+func NewTimerWheel[T any](now int64) *TimerWheel[T] {
+	return &TimerWheel[T]{
+		time: now,
+		next: math.MaxInt64,
+	}
+}
+
+// Len returns the number of scheduled items, including the due ones.
+func (w *TimerWheel[T]) Len() int {
+	return w.len
+}
+
+// Schedule adds item to the wheel, to become due at at.
+func (w *TimerWheel[T]) Schedule(item T, at int64) *TimerElement[T] {
+	e := &TimerElement[T]{Item: item}
+	w.place(e, at)
+	w.len++
+
+	return e
+}
+
+// Reschedule moves e to become due at at.
+func (w *TimerWheel[T]) Reschedule(e *TimerElement[T], at int64) {
+	w.place(e, at)
+}
+
+// Remove removes e from the wheel.
+func (w *TimerWheel[T]) Remove(e *TimerElement[T]) {
+	w.unlink(e).Remove(e.element)
+	e.element = nil
+	w.len--
+}
+
+// Advance moves the wheel forward to now. All items that are due at now
+// can then be retrieved with Peek. If now lies before the time the wheel was
+// advanced to, the clock went backwards: items that are not due at now
+// anymore are scheduled again.
+func (w *TimerWheel[T]) Advance(now int64) {
+	if now < w.time {
+		w.rewind(now)
+		return
+	}
+	if now == w.time {
+		return
+	}
+
+	previous := w.time
+	w.time = now
+
+	for level := 0; level < wheelLevels; level++ {
+		shift := wheelBits * level
+		from, to := previous>>shift, now>>shift
+		if from == to {
+			// Coarser levels did not move either.
+			break
+		}
+
+		if to-from > wheelSize {
+			from = to - wheelSize
+		}
+		for ticks := from + 1; ticks <= to; ticks++ {
+			w.advanceBucket(level, int(ticks&(wheelSize-1)))
+		}
+	}
+
+	w.updateNext()
+}
+
+// rewind moves the wheel back to now. Items in buckets can stay where they
+// are: each bucket is passed again no later than the items in it become due,
+// and passing it early only moves them to another bucket.
+func (w *TimerWheel[T]) rewind(now int64) {
+	w.time = now
+
+	for e := w.due.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.at > now {
+			w.place(e.Value, e.Value.at)
+		}
+		e = next
+	}
+
+	w.updateNext()
+}
+
+// Peek returns an item that is due, or nil if there is none.
+func (w *TimerWheel[T]) Peek() *TimerElement[T] {
+	if front := w.due.Front(); front != nil {
+		return front.Value
+	}
+
+	return nil
+}
+
+// Due returns true if advancing the wheel to now may make items due.
+func (w *TimerWheel[T]) Due(now int64) bool {
+	return w.due.Len() > 0 || w.next <= now
+}
+
+// advanceBucket empties a bucket that was passed: due items are moved to the
+// list of due items, all others are put into a finer level.
+func (w *TimerWheel[T]) advanceBucket(level, bucket int) {
+	list := w.levels[level].buckets[bucket]
+	if list == nil {
+		return
+	}
+
+	// Items may be put back into the same bucket, if they are too far in
+	// the future for the coarsest level. Only look at each item once.
+	for n := list.Len(); n > 0; n-- {
+		e := list.Front().Value
+		w.place(e, e.at)
+	}
+}
+
+// place puts e into the bucket for at, or into the list of due items.
+func (w *TimerWheel[T]) place(e *TimerElement[T], at int64) {
+	var from *List[*TimerElement[T]]
+	if e.element != nil {
+		from = w.unlink(e)
+	}
+
+	e.at = at
+	to := w.listFor(e)
+	if from == nil {
+		e.element = to.PushBack(e)
+		return
+	}
+
+	moveToBack(e.element, from, to)
+}
+
+// listFor returns the list e belongs into, and records its position.
+func (w *TimerWheel[T]) listFor(e *TimerElement[T]) *List[*TimerElement[T]] {
+	if e.at <= w.time {
+		e.level = -1
+		return &w.due
+	}
+
+	level := (bits.Len64(uint64(e.at-w.time)) - 1) / wheelBits
+	if level >= wheelLevels {
+		level = wheelLevels - 1
+	}
+	bucket := int((e.at >> (wheelBits * level)) & (wheelSize - 1))
+	e.level, e.bucket = level, bucket
+
+	l := &w.levels[level]
+	if l.buckets[bucket] == nil {
+		l.buckets[bucket] = NewList[*TimerElement[T]]()
+	}
+	l.occupied |= 1 << bucket
+
+	if e.at < w.next {
+		w.next = e.at
+	}
+
+	return l.buckets[bucket]
+}
+
+// unlink returns the list e is in, and marks its bucket as empty if e is the
+// last item in it.
+func (w *TimerWheel[T]) unlink(e *TimerElement[T]) *List[*TimerElement[T]] {
+	list := e.element.list
+	if list.Len() == 1 && e.level >= 0 {
+		w.levels[e.level].occupied &^= 1 << e.bucket
+	}
+
+	return list
+}
+
+// updateNext computes the start of the next occupied bucket, which is a
+// lower bound of the time at which the next item becomes due.
+func (w *TimerWheel[T]) updateNext() {
+	w.next = math.MaxInt64
+	for level := range w.levels {
+		occupied := w.levels[level].occupied
+		if occupied == 0 {
+			continue
+		}
+
+		shift := wheelBits * level
+		ticks := w.time >> shift
+		// Rotate the bits so that the bucket after the current one comes
+		// first.
+		rotated := bits.RotateLeft64(occupied, -int((ticks+1)&(wheelSize-1)))
+		start := (ticks + 1 + int64(bits.TrailingZeros64(rotated))) << shift
+		if start < w.next {
+			w.next = start
+		}
+	}
+}
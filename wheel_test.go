@@ -0,0 +1,133 @@
+package ezcache
+
+import (
+	"math/rand"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestTimerWheel(t *testing.T) {
+	w := NewTimerWheel[int](1000)
+
+	w.Schedule(1, 1010)
+	w.Schedule(2, 1005)
+	e3 := w.Schedule(3, 1000+5000)
+	w.Schedule(4, 1000+100000000)
+	assert.Equal(t, w.Len(), 4)
+
+	w.Advance(1004)
+	assert.Assert(t, w.Peek() == nil)
+	assert.Equal(t, w.Due(1004), false)
+	assert.Equal(t, w.Due(1005), true)
+
+	w.Advance(1010)
+	e := w.Peek()
+	assert.Equal(t, e.Item, 2)
+	w.Remove(e)
+	e = w.Peek()
+	assert.Equal(t, e.Item, 1)
+	w.Remove(e)
+	assert.Assert(t, w.Peek() == nil)
+
+	w.Reschedule(e3, 1020)
+	w.Advance(1019)
+	assert.Assert(t, w.Peek() == nil)
+	w.Advance(1020)
+	assert.Equal(t, w.Peek().Item, 3)
+	w.Remove(e3)
+
+	// Far in the future, and cascades through all levels.
+	w.Advance(1000 + 100000000 - 1)
+	assert.Assert(t, w.Peek() == nil)
+	w.Advance(1000 + 100000000)
+	assert.Equal(t, w.Peek().Item, 4)
+	assert.Equal(t, w.Len(), 1)
+}
+
+func TestTimerWheelBackwards(t *testing.T) {
+	w := NewTimerWheel[int](1000)
+	w.Schedule(1, 1000+10)
+
+	w.Advance(1000 + 3600000)
+	assert.Equal(t, w.Peek().Item, 1)
+
+	// The clock went back, so 1 is not due anymore, and neither is an item
+	// scheduled in between.
+	w.Advance(1000)
+	w.Schedule(2, 1000+20)
+	assert.Assert(t, w.Peek() == nil)
+	assert.Equal(t, w.Due(1000), false)
+
+	w.Advance(1000 + 10)
+	assert.Equal(t, w.Peek().Item, 1)
+	w.Remove(w.Peek())
+	assert.Assert(t, w.Peek() == nil)
+
+	w.Advance(1000 + 20)
+	assert.Equal(t, w.Peek().Item, 2)
+	w.Remove(w.Peek())
+	assert.Equal(t, w.Len(), 0)
+}
+
+func TestTimerWheelRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	now := int64(1 << 40)
+	w := NewTimerWheel[int](now)
+
+	elements := map[int]*TimerElement[int]{}
+	scheduledAt := map[int]int64{}
+	randomAt := func() int64 {
+		// Spread over all levels of the wheel.
+		return now + r.Int63n(int64(1)<<(r.Intn(40)+1))
+	}
+
+	for i := 0; i < 100000; i++ {
+		switch op := r.Intn(10); {
+		case op < 4:
+			at := randomAt()
+			elements[i] = w.Schedule(i, at)
+			scheduledAt[i] = at
+		case op < 5:
+			for item, e := range elements {
+				at := randomAt()
+				w.Reschedule(e, at)
+				scheduledAt[item] = at
+				break
+			}
+		case op < 6:
+			for item, e := range elements {
+				w.Remove(e)
+				delete(elements, item)
+				delete(scheduledAt, item)
+				break
+			}
+		default:
+			if r.Intn(10) == 0 {
+				// The clock went backwards.
+				now -= r.Int63n(int64(1) << (r.Intn(30) + 1))
+			} else {
+				now += r.Int63n(int64(1) << (r.Intn(30) + 1))
+			}
+			due := false
+			for _, at := range scheduledAt {
+				if at <= now {
+					due = true
+				}
+			}
+			assert.Assert(t, w.Due(now) || !due)
+
+			w.Advance(now)
+			for e := w.Peek(); e != nil; e = w.Peek() {
+				assert.Assert(t, scheduledAt[e.Item] <= now)
+				w.Remove(e)
+				delete(elements, e.Item)
+				delete(scheduledAt, e.Item)
+			}
+			for _, at := range scheduledAt {
+				assert.Assert(t, at > now)
+			}
+		}
+		assert.Equal(t, w.Len(), len(elements))
+	}
+}